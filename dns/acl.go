@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// AclAction is what the server does with a query from a client matched by an Acl.
+type AclAction uint8
+
+const (
+	// resolve the query
+	AclAllow AclAction = iota
+	// answer from the cache only, queries that are not cached are refused
+	AclCacheOnly
+	// answer with REFUSED
+	AclRefuse
+	// drop the query without answering, tcp connections are closed
+	AclDrop
+)
+
+func (a AclAction) String() string {
+	switch a {
+	case AclAllow:
+		return "allow"
+	case AclCacheOnly:
+		return "cache-only"
+	case AclRefuse:
+		return "refuse"
+	case AclDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("AclAction(%d)", uint8(a))
+	}
+}
+
+func ParseAclAction(s string) (AclAction, error) {
+	for _, action := range []AclAction{AclAllow, AclCacheOnly, AclRefuse, AclDrop} {
+		if action.String() == s {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid acl action: %v", s)
+}
+
+type AclRule struct {
+	Prefix netip.Prefix
+	Action AclAction
+}
+
+// Acl decides what to do with the queries of a client by its address. the rule with the longest
+// prefix containing the address applies, Default applies if no rule does.
+type Acl struct {
+	Rules   []AclRule
+	Default AclAction
+}
+
+// allow recursion from loopback and private networks and refuse everyone else, so the server
+// is not an open resolver.
+func DefaultAcl() Acl {
+	acl := Acl{Default: AclRefuse}
+	for _, prefix := range []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "::1/128", "fc00::/7", "fe80::/10"} {
+		acl.Rules = append(acl.Rules, AclRule{Prefix: netip.MustParsePrefix(prefix), Action: AclAllow})
+	}
+	return acl
+}
+
+// an acl with a rule for each prefix, in CIDR notation, with the given action
+func (a Acl) With(action AclAction, prefixes ...string) (Acl, error) {
+	rules := append([]AclRule{}, a.Rules...)
+	for _, s := range prefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Acl{}, fmt.Errorf("invalid acl prefix: %w", err)
+		}
+		rules = append(rules, AclRule{Prefix: prefix.Masked(), Action: action})
+	}
+	return Acl{Rules: rules, Default: a.Default}, nil
+}
+
+func (a *Acl) validate() error {
+	for _, rule := range a.Rules {
+		if !rule.Prefix.IsValid() || rule.Action > AclDrop {
+			return fmt.Errorf("invalid acl rule: %v %v", rule.Prefix, rule.Action)
+		}
+	}
+	if a.Default > AclDrop {
+		return fmt.Errorf("invalid acl default action: %v", a.Default)
+	}
+	return nil
+}
+
+// the action for queries from addr
+func (a *Acl) Action(addr netip.Addr) AclAction {
+	addr = addr.Unmap()
+	action := a.Default
+	bits := -1
+	for _, rule := range a.Rules {
+		if rule.Prefix.Bits() > bits && rule.Prefix.Contains(addr) {
+			action = rule.Action
+			bits = rule.Prefix.Bits()
+		}
+	}
+	return action
+}
+
+// the address and port of a udp or tcp peer, the zero value for other addresses
+func clientAddrOf(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort()
+	case *net.TCPAddr:
+		return addr.AddrPort()
+	}
+	parsed, _ := netip.ParseAddrPort(addr.String())
+	return parsed
+}
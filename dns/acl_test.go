@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAclAction(t *testing.T) {
+	acl := DefaultAcl()
+	assert(t, acl.Action(netip.MustParseAddr("8.8.8.8")), AclRefuse)
+	assert(t, acl.Action(netip.MustParseAddr("192.168.1.10")), AclAllow)
+	assert(t, acl.Action(netip.MustParseAddr("::ffff:10.1.2.3")), AclAllow)
+	assert(t, acl.Action(netip.MustParseAddr("2001:db8::1")), AclRefuse)
+
+	// the most specific rule applies regardless of the order
+	acl, err := acl.With(AclDrop, "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err = acl.With(AclCacheOnly, "10.1.2.0/24", "0.0.0.0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, acl.Action(netip.MustParseAddr("10.1.2.3")), AclCacheOnly)
+	assert(t, acl.Action(netip.MustParseAddr("10.1.3.3")), AclDrop)
+	assert(t, acl.Action(netip.MustParseAddr("10.2.3.3")), AclAllow)
+	assert(t, acl.Action(netip.MustParseAddr("8.8.8.8")), AclCacheOnly)
+
+	_, err = acl.With(AclAllow, "10.0.0.0")
+	assert(t, err != nil, true)
+	action, err := ParseAclAction("cache-only")
+	assert(t, action, AclCacheOnly)
+	assert(t, err, nil)
+}
+
+func TestServerAcl(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listen := func(acl Acl) string {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go server.udpReader(conn, &acl)
+		return conn.LocalAddr().String()
+	}
+	client := &Client{Timeout: 100 * time.Millisecond}
+
+	// cache-only clients are refused names that are not cached
+	cacheOnly, err := Acl{Default: AclAllow}.With(AclCacheOnly, "127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen(cacheOnly)
+	resp, err := client.Exchange(ctx, newQuery("www.example.com", TYPE_A), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_REFUSED)
+
+	resolveTest(t, server.resolver, "www.example.com", TYPE_A)
+	resp, err = client.Exchange(ctx, newQuery("www.example.com", TYPE_A), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+
+	// refused and dropped clients are not resolved for
+	resp, err = client.Exchange(ctx, newQuery("mail.example.com", TYPE_A), listen(Acl{Default: AclRefuse}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_REFUSED)
+
+	_, err = client.Exchange(ctx, newQuery("mail.example.com", TYPE_A), listen(Acl{Default: AclDrop}))
+	assert(t, err != nil, true)
+	// only the cache-only queries reached the workers
+	assert(t, server.SchedulerStats().Accepted, uint64(2))
+}
@@ -13,23 +13,63 @@ var _ AuthorityCache = (*SharedAuthorityCache)(nil)
 type AuthorityCache interface {
 	Get(zone string) []string
 	Put(zone string, nameservers []string, ttl uint32)
+	// the entries that have not expired, sorted by zone
+	Entries() []CachedAuthority
+	Flush(zone string)
+	// flush the zone and every zone below it
+	FlushSubtree(zone string)
+	FlushAll()
 }
 
+// CachedAuthority describes an entry of an AuthorityCache.
+type CachedAuthority struct {
+	Zone        string
+	Nameservers []string
+	Expires     time.Time
+}
+
+// find the nameservers of the zones enclosing domain, from the root to the closest known zone.
+// the root nameservers are taken from the cache if it was primed, otherwise from DefaultRootHints.
 func FindBestAuthorityServers(cache AuthorityCache, domain string) []string {
-	nameservers := slices.Clone(RootNameServers)
-	labels := splitNameIntoLabels(domain)
-	if len(labels) == 0 {
-		return nameservers
+	return FindBestAuthorityServersWithHints(cache, DefaultRootHints(), domain)
+}
+
+// like FindBestAuthorityServers but the root nameservers of an unprimed cache are taken from hints.
+func FindBestAuthorityServersWithHints(cache AuthorityCache, hints *RootHints, domain string) []string {
+	authorities := findBestAuthorities(cache, hints, domain)
+	nameservers := make([]string, len(authorities))
+	for idx, authority := range authorities {
+		nameservers[idx] = authority.nameserver
 	}
+	return nameservers
+}
 
+// a nameserver together with the zone it was delegated
+type authorityServer struct {
+	zone       string
+	nameserver string
+}
+
+func findBestAuthorities(cache AuthorityCache, hints *RootHints, domain string) []authorityServer {
+	rootNameservers := cache.Get(rootZone)
+	if len(rootNameservers) == 0 {
+		rootNameservers = hints.Nameservers
+	}
+
+	authorities := make([]authorityServer, 0, len(rootNameservers))
+	for _, ns := range rootNameservers {
+		authorities = append(authorities, authorityServer{zone: rootZone, nameserver: ns})
+	}
+
+	labels := splitNameIntoLabels(domain)
 	for i := len(labels) - 1; i >= 0; i-- {
 		zone := strings.Join(labels[i:], ".")
 		for _, ns := range cache.Get(zone) {
-			nameservers = append(nameservers, ns)
+			authorities = append(authorities, authorityServer{zone: zone, nameserver: ns})
 		}
 	}
 
-	return nameservers
+	return authorities
 }
 
 type authorityCacheEntry struct {
@@ -70,6 +110,50 @@ func (e *ExclusiveAuthorityCache) Put(zone string, nameservers []string, ttl uin
 	}
 }
 
+// Entries implements AuthorityCache.
+func (e *ExclusiveAuthorityCache) Entries() []CachedAuthority {
+	now := time.Now()
+	entries := make([]CachedAuthority, 0, len(e.entries))
+	for zone, entry := range e.entries {
+		expires := entry.timestamp.Add(time.Duration(entry.ttl) * time.Second)
+		if now.Before(expires) {
+			entries = append(entries, CachedAuthority{
+				Zone:        zone,
+				Nameservers: slices.Clone(entry.nameservers),
+				Expires:     expires,
+			})
+		}
+	}
+	slices.SortFunc(entries, func(a, b CachedAuthority) int {
+		return strings.Compare(a.Zone, b.Zone)
+	})
+	return entries
+}
+
+// Flush implements AuthorityCache.
+func (e *ExclusiveAuthorityCache) Flush(zone string) {
+	for key := range e.entries {
+		if nameEq(key, zone) {
+			delete(e.entries, key)
+		}
+	}
+}
+
+// FlushSubtree implements AuthorityCache.
+func (e *ExclusiveAuthorityCache) FlushSubtree(zone string) {
+	zone = trimWildcard(zone)
+	for key := range e.entries {
+		if isSubdomainOf(key, zone) {
+			delete(e.entries, key)
+		}
+	}
+}
+
+// FlushAll implements AuthorityCache.
+func (e *ExclusiveAuthorityCache) FlushAll() {
+	e.entries = make(map[string]authorityCacheEntry)
+}
+
 type SharedAuthorityCache struct {
 	sync.RWMutex
 	exclusive *ExclusiveAuthorityCache
@@ -83,9 +167,10 @@ func NewSharedAuthorityCache() *SharedAuthorityCache {
 }
 
 // Get implements AuthorityCache.
+// a write lock is required since expired entries are removed.
 func (s *SharedAuthorityCache) Get(zone string) []string {
-	s.RLock()
-	defer s.RUnlock()
+	s.Lock()
+	defer s.Unlock()
 	return s.exclusive.Get(zone)
 }
 
@@ -95,3 +180,57 @@ func (s *SharedAuthorityCache) Put(zone string, nameservers []string, ttl uint32
 	defer s.Unlock()
 	s.exclusive.Put(zone, nameservers, ttl)
 }
+
+// Entries implements AuthorityCache.
+func (s *SharedAuthorityCache) Entries() []CachedAuthority {
+	s.RLock()
+	defer s.RUnlock()
+	return s.exclusive.Entries()
+}
+
+// Flush implements AuthorityCache.
+func (s *SharedAuthorityCache) Flush(zone string) {
+	s.Lock()
+	defer s.Unlock()
+	s.exclusive.Flush(zone)
+}
+
+// FlushSubtree implements AuthorityCache.
+func (s *SharedAuthorityCache) FlushSubtree(zone string) {
+	s.Lock()
+	defer s.Unlock()
+	s.exclusive.FlushSubtree(zone)
+}
+
+// FlushAll implements AuthorityCache.
+func (s *SharedAuthorityCache) FlushAll() {
+	s.Lock()
+	defer s.Unlock()
+	s.exclusive.FlushAll()
+}
+
+func (s *SharedAuthorityCache) snapshot() []authoritySnapshotEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	entries := make([]authoritySnapshotEntry, 0, len(s.exclusive.entries))
+	for zone, entry := range s.exclusive.entries {
+		entries = append(entries, authoritySnapshotEntry{
+			Zone:        zone,
+			Nameservers: entry.nameservers,
+			Timestamp:   entry.timestamp,
+			Expires:     entry.timestamp.Add(time.Duration(entry.ttl) * time.Second),
+		})
+	}
+	return entries
+}
+
+func (s *SharedAuthorityCache) restore(entry authoritySnapshotEntry) {
+	s.Lock()
+	defer s.Unlock()
+	s.exclusive.entries[entry.Zone] = authorityCacheEntry{
+		nameservers: entry.Nameservers,
+		ttl:         uint32(entry.Expires.Sub(entry.Timestamp).Seconds()),
+		timestamp:   entry.Timestamp,
+	}
+}
@@ -66,8 +66,11 @@ func (w *dnsBuffer) WriteU32(v uint32) {
 	w.Write(buf)
 }
 
+// writes past the end of the buffer are dropped, see Truncated
 func (w *dnsBuffer) Write(buf []byte) {
-	copy(w.buffer[w.cursor:], buf)
+	if w.cursor < len(w.buffer) {
+		copy(w.buffer[w.cursor:], buf)
+	}
 	w.cursor += len(buf)
 }
 
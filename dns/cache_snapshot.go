@@ -0,0 +1,168 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// written at the start of every snapshot file, followed by the version
+const cacheSnapshotMagic = "DNSCACHE"
+
+// incremented whenever the snapshot format changes, snapshots of other versions are ignored
+const cacheSnapshotVersion uint32 = 2
+
+var ErrInvalidCacheSnapshot = fmt.Errorf("invalid cache snapshot")
+
+type cacheSnapshot struct {
+	Created     time.Time
+	Authorities []authoritySnapshotEntry
+	Resources   []resourceSnapshotEntry
+}
+
+type authoritySnapshotEntry struct {
+	Zone        string
+	Nameservers []string
+	Timestamp   time.Time
+	Expires     time.Time
+}
+
+type resourceSnapshotEntry struct {
+	Domain      string
+	Type        uint16
+	Negative    bool
+	Rcode       uint8
+	Credibility Credibility
+	Timestamp   time.Time
+	Expires     time.Time
+	// records in wire format, with the ttl they had when inserted
+	Records [][]byte
+}
+
+// write the contents of the caches to path.
+// the snapshot is written to a temporary file first so an existing snapshot is never left half written.
+func SaveCacheSnapshot(path string, authorityCache *SharedAuthorityCache, resourceCache *SharedResourceCache) error {
+	snapshot := cacheSnapshot{
+		Created:     time.Now(),
+		Authorities: authorityCache.snapshot(),
+		Resources:   resourceCache.snapshot(),
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	if err := writeCacheSnapshot(writer, &snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// load a snapshot written by SaveCacheSnapshot into the caches, skipping expired entries.
+// returns ErrInvalidCacheSnapshot if the file is corrupt or was written by an incompatible version,
+// in which case the caches are left untouched.
+func LoadCacheSnapshot(path string, authorityCache *SharedAuthorityCache, resourceCache *SharedResourceCache) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshot, err := readCacheSnapshot(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	resources := make([]resourceSnapshotEntry, 0, len(snapshot.Resources))
+	for _, entry := range snapshot.Resources {
+		if now.Before(entry.Expires) {
+			resources = append(resources, entry)
+		}
+	}
+	if err := resourceCache.restore(resources); err != nil {
+		return err
+	}
+
+	for _, entry := range snapshot.Authorities {
+		if now.Before(entry.Expires) {
+			authorityCache.restore(entry)
+		}
+	}
+
+	return nil
+}
+
+func writeCacheSnapshot(w io.Writer, snapshot *cacheSnapshot) error {
+	if _, err := io.WriteString(w, cacheSnapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, cacheSnapshotVersion); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(snapshot)
+}
+
+func readCacheSnapshot(r io.Reader) (*cacheSnapshot, error) {
+	magic := make([]byte, len(cacheSnapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != cacheSnapshotMagic {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidCacheSnapshot)
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("%w: missing version", ErrInvalidCacheSnapshot)
+	}
+	if version != cacheSnapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidCacheSnapshot, version)
+	}
+
+	snapshot := &cacheSnapshot{}
+	if err := gob.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCacheSnapshot, err)
+	}
+	return snapshot, nil
+}
+
+func encodeSnapshotRecord(rr RR) ([]byte, error) {
+	buf := newDnsBuffer(make([]byte, MessageSizeLimitTCP))
+	if err := encodeResourceRecord(buf, rr); err != nil {
+		return nil, err
+	}
+	if buf.Truncated() {
+		return nil, ErrResourceRecordDataToLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSnapshotRecord(b []byte) (rr RR, err error) {
+	// the decoder does not check bounds on every field, a corrupt record could make it panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: corrupt record: %v", ErrInvalidCacheSnapshot, r)
+		}
+	}()
+	buf := newDnsBuffer(b)
+	rr, err = decodeResourceRecord(buf)
+	if err == nil && buf.Remain() != 0 {
+		err = fmt.Errorf("%w: trailing data after record", ErrInvalidCacheSnapshot)
+	}
+	return rr, err
+}
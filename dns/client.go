@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ Transport = (*Client)(nil)
+
+const defaultClientTimeout = 2 * time.Second
+
+// buffer size recommended by the DNS flag day 2020 to avoid ip fragmentation
+const DefaultEdnsBufferSize = 1232
+
+// Client sends queries to dns servers. the zero value sends queries over udp
+// without EDNS, retrying over tcp when the response is truncated.
+// it is safe for concurrent use.
+type Client struct {
+	// "udp" or "tcp", defaults to "udp"
+	Net string
+	// how long to wait for the response to a single attempt, defaults to 2 seconds
+	Timeout time.Duration
+	// number of times a udp query is resent when no response arrives in time, negative values are treated as zero
+	Retries int
+	// advertise this udp receive buffer size with an EDNS OPT record (RFC 6891), disabled if zero
+	UDPSize uint16
+	// keep tcp connections open after a query and reuse them for the next query to the same server
+	ReuseConnections bool
+	Dialer           net.Dialer
+
+	mu   sync.Mutex
+	idle map[string]net.Conn
+}
+
+// Exchange implements Transport.
+// the response is checked to match the id and question of msg.
+func (c *Client) Exchange(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	msg = c.withEdns(msg)
+
+	var resp *Message
+	var err error
+	switch c.Net {
+	case "", "udp":
+		resp, err = c.exchangeUdp(ctx, msg, addr)
+		if err == nil && resp.Header.Truncated {
+			slog.Debug("truncated response, retrying over tcp", "address", addr)
+			resp, err = c.exchangeTcp(ctx, msg, addr)
+		}
+	case "tcp":
+		resp, err = c.exchangeTcp(ctx, msg, addr)
+	default:
+		return nil, fmt.Errorf("unsupported client network: %v", c.Net)
+	}
+	return resp, err
+}
+
+// close the connections kept open for reuse
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, conn := range c.idle {
+		conn.Close()
+		delete(c.idle, addr)
+	}
+	return nil
+}
+
+// add an OPT record to a copy of msg if EDNS is enabled and msg does not have one
+func (c *Client) withEdns(msg *Message) *Message {
+	if c.UDPSize == 0 {
+		return msg
+	}
+	for _, rr := range msg.Additional {
+		if rr.Type == TYPE_OPT {
+			return msg
+		}
+	}
+
+	opt := RR{
+		RR_Header: RR_Header{Name: rootZone, Type: TYPE_OPT, Class: c.UDPSize},
+		Data:      &RR_Unknown{},
+	}
+	copied := *msg
+	copied.Additional = append(append(make([]RR, 0, len(msg.Additional)+1), msg.Additional...), opt)
+	copied.Header.AdditionalCount += 1
+	return &copied
+}
+
+// the deadline of a single attempt
+func (c *Client) deadline(ctx context.Context) time.Time {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+func (c *Client) exchangeUdp(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	encoded, err := Encode(msg, MessageSizeLimitTCP)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.Dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// unblock reads if the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, max(int(c.UDPSize), MessageSizeLimitUDP))
+	var lastErr error
+	for attempt := 0; attempt <= max(c.Retries, 0); attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(encoded); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(c.deadline(ctx)); err != nil {
+			return nil, err
+		}
+
+		resp, err := readUdpResponse(conn, buf, msg)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		slog.Debug("udp query timed out", "address", addr, "attempt", attempt+1)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// read datagrams until one is a response to msg or the read deadline expires.
+// datagrams that are not a response to msg, like late responses to previous attempts
+// or spoofed responses, are ignored.
+func readUdpResponse(conn net.Conn, buf []byte, msg *Message) (*Message, error) {
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := Decode(buf[:n])
+		if err != nil {
+			slog.Debug("ignoring undecodable datagram", "error", err)
+			continue
+		}
+		if err := validateResponse(msg, resp); err != nil {
+			slog.Debug("ignoring unexpected response", "error", err)
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) exchangeTcp(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	conn, reused, err := c.getConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeTcpConn(ctx, conn, msg, c.deadline(ctx))
+	if err != nil {
+		conn.Close()
+		// the server may have closed the idle connection, try again on a new one
+		if reused && ctx.Err() == nil {
+			slog.Debug("reused connection failed, reconnecting", "address", addr, "error", err)
+			return c.exchangeTcp(ctx, msg, addr)
+		}
+		return nil, err
+	}
+
+	c.putConn(addr, conn)
+	return resp, nil
+}
+
+func exchangeTcpConn(ctx context.Context, conn net.Conn, msg *Message, deadline time.Time) (*Message, error) {
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err := writeTcpMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	resp, err := readTcpMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(msg, resp); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return resp, nil
+}
+
+// an idle connection to addr if there is one, otherwise a new connection
+func (c *Client) getConn(ctx context.Context, addr string) (net.Conn, bool, error) {
+	if c.ReuseConnections {
+		c.mu.Lock()
+		conn, ok := c.idle[addr]
+		delete(c.idle, addr)
+		c.mu.Unlock()
+		if ok {
+			return conn, true, nil
+		}
+	}
+	conn, err := c.Dialer.DialContext(ctx, "tcp", addr)
+	return conn, false, err
+}
+
+// keep the connection for reuse, or close it
+func (c *Client) putConn(addr string, conn net.Conn) {
+	if !c.ReuseConnections {
+		conn.Close()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = make(map[string]net.Conn)
+	}
+	if _, ok := c.idle[addr]; ok {
+		conn.Close()
+		return
+	}
+	c.idle[addr] = conn
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ClientLimits cap the recursion work each client can cause. clients are grouped by network
+// prefix, queries over the limits are refused before they reach the workers.
+type ClientLimits struct {
+	// queries per second of each client, zero disables the limit
+	QueriesPerSecond int
+	// queries a client can send at once after being idle, defaults to QueriesPerSecond
+	Burst int
+	// maximum number of queries of a client being resolved at the same time, zero disables the limit
+	MaxOutstanding int
+	// length of the prefixes clients are grouped by, a single address by default
+	Ipv4PrefixLength int
+	Ipv6PrefixLength int
+	// clients that are not limited
+	Exempt []netip.Prefix
+	// maximum number of clients tracked. idle clients that are no longer limited are evicted to
+	// make room, the queries of new clients are refused while none can be evicted.
+	MaxEntries int
+}
+
+func DefaultClientLimits() ClientLimits {
+	return ClientLimits{
+		QueriesPerSecond: 100,
+		MaxOutstanding:   32,
+		Ipv4PrefixLength: 32,
+		Ipv6PrefixLength: 128,
+		Exempt:           []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+		MaxEntries:       100000,
+	}
+}
+
+func (l *ClientLimits) validate() error {
+	if l.QueriesPerSecond < 0 || l.Burst < 0 || l.MaxOutstanding < 0 ||
+		l.Ipv4PrefixLength < 0 || l.Ipv4PrefixLength > 32 || l.Ipv6PrefixLength < 0 || l.Ipv6PrefixLength > 128 ||
+		l.MaxEntries <= 0 {
+		return fmt.Errorf("invalid client limits: %+v", *l)
+	}
+	for _, prefix := range l.Exempt {
+		if !prefix.IsValid() {
+			return fmt.Errorf("invalid client limits exemption: %v", prefix)
+		}
+	}
+	return nil
+}
+
+// ClientStats are the counters of a client tracked by the client limits.
+type ClientStats struct {
+	Prefix netip.Prefix
+	// queries admitted
+	Queries uint64
+	// queries refused because a limit was reached
+	Limited uint64
+	// queries being resolved
+	Outstanding int
+}
+
+type clientState struct {
+	stats   ClientStats
+	tokens  float64
+	updated time.Time
+}
+
+type clientLimiter struct {
+	limits ClientLimits
+	now    func() time.Time
+
+	mu      sync.Mutex
+	clients map[netip.Prefix]*clientState
+}
+
+func newClientLimiter(limits ClientLimits) *clientLimiter {
+	if limits.Burst == 0 {
+		limits.Burst = limits.QueriesPerSecond
+	}
+	return &clientLimiter{
+		limits:  limits,
+		now:     time.Now,
+		clients: make(map[netip.Prefix]*clientState),
+	}
+}
+
+func (l *clientLimiter) exempt(addr netip.Addr) bool {
+	for _, prefix := range l.limits.Exempt {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit a query from client. if it is admitted the returned function must be called once the
+// query is answered.
+func (l *clientLimiter) admit(client netip.Addr) (func(), bool) {
+	client = client.Unmap()
+	if !client.IsValid() || l.exempt(client) {
+		return func() {}, true
+	}
+	bits := l.limits.Ipv6PrefixLength
+	if client.Is4() {
+		bits = l.limits.Ipv4PrefixLength
+	}
+	prefix, err := client.Prefix(bits)
+	if err != nil {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	state, ok := l.clients[prefix]
+	if !ok {
+		if len(l.clients) >= l.limits.MaxEntries {
+			l.evict(now)
+		}
+		if len(l.clients) >= l.limits.MaxEntries {
+			slog.Debug("client limits table is full, refusing query of new client", "client", prefix, "entries", len(l.clients))
+			return nil, false
+		}
+		state = &clientState{stats: ClientStats{Prefix: prefix}, tokens: float64(l.limits.Burst), updated: now}
+		l.clients[prefix] = state
+	}
+
+	if l.limits.QueriesPerSecond != 0 {
+		refilled := now.Sub(state.updated).Seconds() * float64(l.limits.QueriesPerSecond)
+		state.tokens = min(float64(l.limits.Burst), state.tokens+refilled)
+		state.updated = now
+	}
+
+	limited := (l.limits.QueriesPerSecond != 0 && state.tokens < 1) ||
+		(l.limits.MaxOutstanding != 0 && state.stats.Outstanding >= l.limits.MaxOutstanding)
+	if limited {
+		state.stats.Limited += 1
+		if state.stats.Limited == 1 {
+			slog.Info("client query limit reached", "client", prefix)
+		}
+		return nil, false
+	}
+
+	if l.limits.QueriesPerSecond != 0 {
+		state.tokens -= 1
+	}
+	state.stats.Queries += 1
+	state.stats.Outstanding += 1
+
+	released := false
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !released {
+			released = true
+			state.stats.Outstanding -= 1
+		}
+	}, true
+}
+
+// remove the idle clients whose bucket would be full by now, tracking them again later
+// starts from the same state. clients that are still limited are never evicted.
+func (l *clientLimiter) evict(now time.Time) {
+	rate := float64(l.limits.QueriesPerSecond)
+	for prefix, state := range l.clients {
+		if state.stats.Outstanding == 0 && (rate == 0 || state.tokens+now.Sub(state.updated).Seconds()*rate >= float64(l.limits.Burst)) {
+			delete(l.clients, prefix)
+		}
+	}
+}
+
+// the counters of every tracked client, sorted by the number of queries
+func (l *clientLimiter) stats() []ClientStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]ClientStats, 0, len(l.clients))
+	for _, state := range l.clients {
+		stats = append(stats, state.stats)
+	}
+	slices.SortFunc(stats, func(a, b ClientStats) int {
+		return cmp.Compare(b.Queries, a.Queries)
+	})
+	return stats
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	limits := DefaultClientLimits()
+	limits.QueriesPerSecond = 2
+	limits.MaxOutstanding = 2
+	limits.Ipv4PrefixLength = 24
+	limiter := newClientLimiter(limits)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	client := netip.MustParseAddr("192.0.2.1")
+	neighbour := netip.MustParseAddr("192.0.2.2")
+
+	// the burst is shared by the prefix
+	release1, ok := limiter.admit(client)
+	assert(t, ok, true)
+	_, ok = limiter.admit(neighbour)
+	assert(t, ok, true)
+	_, ok = limiter.admit(client)
+	assert(t, ok, false)
+
+	// once refilled the outstanding limit still applies until a query is answered
+	now = now.Add(time.Second)
+	_, ok = limiter.admit(client)
+	assert(t, ok, false)
+	release1()
+	release1()
+	_, ok = limiter.admit(client)
+	assert(t, ok, true)
+
+	// exempt clients are not limited or tracked
+	for i := 0; i < 10; i++ {
+		_, ok = limiter.admit(netip.MustParseAddr("127.0.0.1"))
+		assert(t, ok, true)
+	}
+
+	stats := limiter.stats()
+	assert(t, len(stats), 1)
+	assert(t, stats[0].Prefix, netip.MustParsePrefix("192.0.2.0/24"))
+	assert(t, stats[0].Queries, uint64(3))
+	assert(t, stats[0].Limited, uint64(2))
+	assert(t, stats[0].Outstanding, 2)
+}
+
+func TestClientLimiterEviction(t *testing.T) {
+	limits := DefaultClientLimits()
+	limits.QueriesPerSecond = 1
+	limits.Burst = 2
+	limits.MaxEntries = 2
+	limiter := newClientLimiter(limits)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	client := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		release, ok := limiter.admit(client)
+		assert(t, ok, true)
+		release()
+	}
+	_, ok := limiter.admit(client)
+	assert(t, ok, false)
+
+	// the limited client is not evicted to make room for new ones
+	release, ok := limiter.admit(netip.MustParseAddr("198.51.100.1"))
+	assert(t, ok, true)
+	release()
+	for i := 0; i < 10; i++ {
+		_, ok = limiter.admit(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}))
+		assert(t, ok, false)
+	}
+	_, ok = limiter.admit(client)
+	assert(t, ok, false)
+	assert(t, len(limiter.stats()), 2)
+
+	// clients are evicted once their bucket is full again
+	now = now.Add(2 * time.Second)
+	_, ok = limiter.admit(netip.MustParseAddr("10.0.0.1"))
+	assert(t, ok, true)
+	stats := limiter.stats()
+	assert(t, len(stats), 1)
+	assert(t, stats[0].Prefix, netip.MustParsePrefix("10.0.0.1/32"))
+}
+
+func TestServerClientLimits(t *testing.T) {
+	network := newFakeHierarchy(t)
+	network.server("198.41.0.4").delay = time.Minute
+	limits := DefaultClientLimits()
+	limits.MaxOutstanding = 1
+	server := newTestServer(t, network, WithClientLimits(limits), WithAcl(Acl{Default: AclAllow}))
+
+	responses := make(chan *Message, 16)
+	submit := func(client string) {
+		server.submitQuery(AclAllow, workerJob{
+			message:   newQuery("www.example.com", TYPE_A),
+			client:    netip.MustParseAddrPort(client),
+			responder: func(m *Message) { responses <- m },
+		})
+	}
+
+	// the second query of the client is refused while the first is being resolved
+	submit("192.0.2.1:5353")
+	submit("192.0.2.1:5354")
+	submit("192.0.2.2:5353")
+	assert(t, len(responses), 1)
+	assert(t, (<-responses).Header.ResponseCode, RCODE_REFUSED)
+	assert(t, server.SchedulerStats().Accepted, uint64(2))
+
+	stats := server.ClientStats()
+	assert(t, len(stats), 2)
+	for _, client := range stats {
+		assert(t, client.Outstanding, 1)
+	}
+}
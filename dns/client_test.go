@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// listen for udp and tcp on the same local port
+func listenLocal(t *testing.T) (net.PacketConn, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, listener
+}
+
+func testAnswer(query *Message, truncated bool) *Message {
+	resp := &Message{Questions: query.Questions}
+	resp.Header.Id = query.Header.Id
+	resp.Header.Response = true
+	resp.Header.Truncated = truncated
+	resp.Header.QuestionCount = 1
+	if !truncated {
+		resp.Header.AnswerCount = 1
+		resp.Answers = []RR{{
+			RR_Header: RR_Header{Name: query.Questions[0].Name, Type: TYPE_A, Class: CLASS_IN, TTL: 60},
+			Data:      &RR_A{Addr: [4]byte{10, 0, 0, 1}},
+		}}
+	}
+	return resp
+}
+
+func TestClientExchange(t *testing.T) {
+	udp, tcp := listenLocal(t)
+
+	udpQueries := make(chan *Message, 8)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			udpQueries <- query
+
+			// a response to some other query is ignored by the client
+			other := testAnswer(query, false)
+			other.Header.Id += 1
+			encoded, _ := Encode(other, MessageSizeLimitUDP)
+			udp.WriteTo(encoded, addr)
+
+			encoded, _ = Encode(testAnswer(query, true), MessageSizeLimitUDP)
+			udp.WriteTo(encoded, addr)
+		}
+	}()
+
+	tcpConns := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			tcpConns <- struct{}{}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readTcpMessage(conn)
+					if err != nil {
+						return
+					}
+					if err := writeTcpMessage(conn, testAnswer(query, false)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &Client{UDPSize: DefaultEdnsBufferSize, ReuseConnections: true}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Exchange(ctx, newQuery("example.com", TYPE_A), tcp.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, resp.Header.Truncated, false)
+		assert(t, len(resp.Answers), 1)
+
+		query := <-udpQueries
+		assert(t, len(query.Additional), 1)
+		assert(t, query.Additional[0].Type, TYPE_OPT)
+		assert(t, query.Additional[0].Class, uint16(DefaultEdnsBufferSize))
+	}
+
+	// the tcp connection of the first truncated response was reused
+	assert(t, len(tcpConns), 1)
+}
+
+func TestClientTimeout(t *testing.T) {
+	udp, _ := listenLocal(t)
+
+	received := make(chan struct{}, 8)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := udp.ReadFrom(buf); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	client := &Client{Timeout: 50 * time.Millisecond, Retries: 2}
+	_, err := client.Exchange(context.Background(), newQuery("example.com", TYPE_A), udp.LocalAddr().String())
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	assert(t, len(received), 3)
+
+	// a negative number of retries sends the query once
+	client = &Client{Timeout: 50 * time.Millisecond, Retries: -1}
+	_, err = client.Exchange(context.Background(), newQuery("example.com", TYPE_A), udp.LocalAddr().String())
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	assert(t, len(received), 4)
+}
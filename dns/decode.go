@@ -1,13 +1,21 @@
 package dns
 
 import (
+	"fmt"
 	"strings"
 )
 
-func Decode(b []byte) (*Message, error) {
+func Decode(b []byte) (message *Message, err error) {
+	// the decoding functions do not check bounds on every read, a truncated message makes them panic
+	defer func() {
+		if r := recover(); r != nil {
+			message, err = nil, fmt.Errorf("%w: %v", ErrInsufficientData, r)
+		}
+	}()
+
 	buf := newDnsBuffer(b)
 
-	message := &Message{}
+	message = &Message{}
 	if err := decodeHeader(buf, &message.Header); err != nil {
 		return nil, err
 	}
@@ -44,10 +44,20 @@ var RootNameServersIpv4 map[string][4]byte = map[string][4]byte{
 	"m.root-servers.net.": {202, 12, 27, 33},
 }
 
-var RootServersIpv4 []net.IP = []net.IP{
-	net.IPv4(198, 41, 0, 4),    // a
-	net.IPv4(170, 247, 170, 2), // b
-	net.IPv4(192, 33, 4, 12),   // c
+var RootNameServersIpv6 map[string][16]byte = map[string][16]byte{
+	"a.root-servers.net.": {0x20, 0x01, 0x05, 0x03, 0xba, 0x3e, 0, 0, 0, 0, 0, 0, 0, 0x02, 0, 0x30},
+	"b.root-servers.net.": {0x28, 0x01, 0x01, 0xb8, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0b},
+	"c.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0c},
+	"d.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0x2d, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0d},
+	"e.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0xa8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0e},
+	"f.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0x2f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0f},
+	"g.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0x12, 0, 0, 0, 0, 0, 0, 0, 0, 0x0d, 0x0d},
+	"h.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53},
+	"i.root-servers.net.": {0x20, 0x01, 0x07, 0xfe, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53},
+	"j.root-servers.net.": {0x20, 0x01, 0x05, 0x03, 0x0c, 0x27, 0, 0, 0, 0, 0, 0, 0, 0x02, 0, 0x30},
+	"k.root-servers.net.": {0x20, 0x01, 0x07, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01},
+	"l.root-servers.net.": {0x20, 0x01, 0x05, 0x00, 0x00, 0x9f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x42},
+	"m.root-servers.net.": {0x20, 0x01, 0x0d, 0xc3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x35},
 }
 
 func genRandomId() uint16 {
@@ -112,7 +122,28 @@ func labelEq(lhs, rhs string) bool {
 func nameEq(lhs, rhs string) bool {
 	lhsLabels := splitNameIntoLabels(lhs)
 	rhsLabels := splitNameIntoLabels(rhs)
-	return slices.Equal(lhsLabels, rhsLabels)
+	return slices.EqualFunc(lhsLabels, rhsLabels, labelEq)
+}
+
+// check if name is equal to zone or is below it
+func isSubdomainOf(name, zone string) bool {
+	nameLabels := splitNameIntoLabels(name)
+	zoneLabels := splitNameIntoLabels(zone)
+	if len(zoneLabels) > len(nameLabels) {
+		return false
+	}
+	offset := len(nameLabels) - len(zoneLabels)
+	for i, label := range zoneLabels {
+		if !labelEq(nameLabels[offset+i], label) {
+			return false
+		}
+	}
+	return true
+}
+
+// remove the leading "*." of a wildcard name, "*.example.com" refers to the subtree of "example.com"
+func trimWildcard(name string) string {
+	return strings.TrimPrefix(name, "*.")
 }
 
 // check how many labels the names have in common starting from the root until the first non common label
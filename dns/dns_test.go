@@ -1,6 +1,14 @@
 package dns
 
-import "testing"
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func assert[T comparable](t *testing.T, lhs, rhs T, msg ...string) {
 	if lhs != rhs {
@@ -25,3 +33,250 @@ func TestSplitNameIntoLabels(t *testing.T) {
 	assert(t, s[2], "com")
 	assert(t, len(s), 3)
 }
+
+func TestAddressFamily(t *testing.T) {
+	v4 := sockAddr{Ip: net.ParseIP("10.0.0.1"), Port: 53}
+	v4mapped := sockAddr{Ip: net.ParseIP("::ffff:10.0.0.2"), Port: 53}
+	v6 := sockAddr{Ip: net.ParseIP("2001:db8::1"), Port: 53}
+
+	assert(t, AddressFamilyAny.allows(v4), true)
+	assert(t, AddressFamilyAny.allows(v6), true)
+	assert(t, AddressFamilyIpv4.allows(v4), true)
+	assert(t, AddressFamilyIpv4.allows(v4mapped), true)
+	assert(t, AddressFamilyIpv4.allows(v6), false)
+	assert(t, AddressFamilyIpv6.allows(v4), false)
+	assert(t, AddressFamilyIpv6.allows(v4mapped), false)
+	assert(t, AddressFamilyIpv6.allows(v6), true)
+
+	// the families alternate starting with ipv6, the order within a family is kept
+	v6b := sockAddr{Ip: net.ParseIP("2001:db8::2"), Port: 53}
+	v6c := sockAddr{Ip: net.ParseIP("2001:db8::3"), Port: 53}
+	interleaved := interleaveAddressFamilies([]sockAddr{v4, v4mapped, v6, v6b, v6c})
+	expected := []sockAddr{v6, v4, v6b, v4mapped, v6c}
+	assert(t, len(interleaved), len(expected))
+	for i := range expected {
+		assert(t, interleaved[i].String(), expected[i].String())
+	}
+	assert(t, len(interleaveAddressFamilies(nil)), 0)
+}
+
+func TestParseRootHints(t *testing.T) {
+	hints, err := ParseRootHints(strings.NewReader(`
+;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; FORMERLY NS1.ISI.EDU
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+; End of file`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(hints.Nameservers), 2)
+	assert(t, hints.Nameservers[0], "a.root-servers.net")
+	assert(t, hints.Nameservers[1], "b.root-servers.net")
+	assert(t, hints.Ipv4["a.root-servers.net"], [4]byte{198, 41, 0, 4})
+	assert(t, hints.Ipv6["a.root-servers.net"], RootNameServersIpv6["a.root-servers.net."])
+	assert(t, len(hints.addressRRs("B.ROOT-SERVERS.NET.", TYPE_A)), 1)
+	assert(t, len(hints.addressRRs("b.root-servers.net", TYPE_AAAA)), 0)
+}
+
+func TestFindBestAuthorityServers(t *testing.T) {
+	cache := NewSharedAuthorityCache()
+	cache.Put("com", []string{"a.gtld-servers.net"}, 300)
+
+	// the root nameservers of an unprimed cache come from the hints
+	nameservers := FindBestAuthorityServers(cache, "www.example.com")
+	assert(t, len(nameservers), len(DefaultRootHints().Nameservers)+1)
+	assert(t, nameservers[len(nameservers)-1], "a.gtld-servers.net")
+
+	hints := &RootHints{Nameservers: []string{"a.root-servers.net"}}
+	nameservers = FindBestAuthorityServersWithHints(cache, hints, "www.example.com")
+	assert(t, strings.Join(nameservers, " "), "a.root-servers.net a.gtld-servers.net")
+}
+
+func TestResourceCacheTTLBounds(t *testing.T) {
+	cache := NewSharedResourceCacheWithConfig(ResourceCacheConfig{
+		TTL:         TTLBounds{Min: time.Minute, Max: time.Hour},
+		NegativeTTL: TTLBounds{Max: 5 * time.Minute},
+		TypeTTL:     map[uint16]TTLBounds{TYPE_TXT: {Min: 10 * time.Second}},
+		ZoneTTL:     map[string]TTLBounds{"cdn.example.com": {Min: 5 * time.Second}},
+	})
+	record := func(name string, ty uint16, ttl uint32) []RR {
+		return []RR{{RR_Header: RR_Header{Name: name, Type: ty, Class: CLASS_IN, TTL: ttl}, Data: &RR_A{}}}
+	}
+
+	cache.Put("example.com", TYPE_A, record("example.com", TYPE_A, 0), CredibilityAnswer)
+	assert(t, cache.Get("example.com", TYPE_A)[0].TTL, uint32(60))
+
+	cache.Put("example.com", TYPE_AAAA, record("example.com", TYPE_AAAA, 604800), CredibilityAnswer)
+	assert(t, cache.Get("example.com", TYPE_AAAA)[0].TTL, uint32(3600))
+
+	cache.Put("example.com", TYPE_TXT, record("example.com", TYPE_TXT, 1), CredibilityAnswer)
+	assert(t, cache.Get("example.com", TYPE_TXT)[0].TTL, uint32(10))
+
+	cache.Put("a.cdn.example.com", TYPE_A, record("a.cdn.example.com", TYPE_A, 1), CredibilityAnswer)
+	assert(t, cache.Get("a.cdn.example.com", TYPE_A)[0].TTL, uint32(5))
+
+	soa := []RR{{RR_Header: RR_Header{Name: "example.com", Type: TYPE_SOA, Class: CLASS_IN, TTL: 3600}, Data: &RR_SOA{MINIMUM: 86400}}}
+	cache.PutNegative("missing.example.com", TYPE_A, RCODE_NAME_ERROR, soa)
+	rcode, authority, ok := cache.GetNegative("missing.example.com", TYPE_A)
+	assert(t, ok, true)
+	assert(t, rcode, RCODE_NAME_ERROR)
+	assert(t, authority[0].TTL, uint32(300))
+	assert(t, len(cache.Get("missing.example.com", TYPE_A)), 0)
+}
+
+func TestEncodeUnknownRR(t *testing.T) {
+	msg := &Message{
+		Questions: []Question{{Name: "example.com", Type: 65280, Class: CLASS_IN}},
+		Answers:   []RR{{RR_Header: RR_Header{Name: "example.com", Type: 65280, Class: CLASS_IN, TTL: 300}, Data: &RR_Unknown{Data: []byte{1, 2, 3}}}},
+	}
+	msg.Header.QuestionCount = 1
+	msg.Header.AnswerCount = 1
+	encoded, err := Encode(msg, MessageSizeLimitTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rdata is written once, after the rdlength of the record
+	assert(t, string(encoded[len(encoded)-5:]), string([]byte{0, 3, 1, 2, 3}))
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(decoded.Answers), 1)
+	assert(t, string(decoded.Answers[0].Data.(*RR_Unknown).Data), string([]byte{1, 2, 3}))
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	authorityCache := NewSharedAuthorityCache()
+	resourceCache := NewSharedResourceCache()
+	authorityCache.Put("com", []string{"a.gtld-servers.net"}, 3600)
+	resourceCache.Put("example.com", TYPE_A, []RR{{RR_Header: RR_Header{Name: "example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 300}, Data: &RR_A{Addr: [4]byte{192, 0, 2, 1}}}}, CredibilityAnswer)
+	resourceCache.Put("example.com", TYPE_TXT, []RR{{RR_Header: RR_Header{Name: "example.com", Type: TYPE_TXT, Class: CLASS_IN, TTL: 0}, Data: &RR_TXT{Data: "expired"}}}, CredibilityAnswer)
+
+	if err := SaveCacheSnapshot(path, authorityCache, resourceCache); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredAuthorities := NewSharedAuthorityCache()
+	restoredResources := NewSharedResourceCache()
+	if err := LoadCacheSnapshot(path, restoredAuthorities, restoredResources); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restoredAuthorities.Get("com")[0], "a.gtld-servers.net")
+	rrs := restoredResources.Get("example.com", TYPE_A)
+	assert(t, len(rrs), 1)
+	assert(t, rrs[0].Data.(*RR_A).Addr, [4]byte{192, 0, 2, 1})
+	assert(t, len(restoredResources.Get("example.com", TYPE_TXT)), 0)
+
+	if err := os.WriteFile(path, []byte("DNSCACHE\x00\x00\x00\x01garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := LoadCacheSnapshot(path, restoredAuthorities, restoredResources)
+	assert(t, errors.Is(err, ErrInvalidCacheSnapshot), true)
+}
+
+func TestResourceCacheFlush(t *testing.T) {
+	cache := NewSharedResourceCache()
+	for _, name := range []string{"example.com", "www.example.com", "a.b.example.com", "example.org"} {
+		cache.Put(name, TYPE_A, []RR{{RR_Header: RR_Header{Name: name, Type: TYPE_A, Class: CLASS_IN, TTL: 300}, Data: &RR_A{}}}, CredibilityAnswer)
+	}
+	cache.Put("example.com", TYPE_AAAA, []RR{{RR_Header: RR_Header{Name: "example.com", Type: TYPE_AAAA, Class: CLASS_IN, TTL: 300}, Data: &RR_AAAA{}}}, CredibilityAnswer)
+
+	assert(t, len(cache.Entries()), 5)
+	assert(t, len(cache.Lookup("EXAMPLE.com.")), 2)
+
+	cache.Flush("example.com", TYPE_AAAA)
+	assert(t, len(cache.Lookup("example.com")), 1)
+
+	cache.FlushSubtree("*.example.com")
+	entries := cache.Entries()
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Domain, "example.org")
+
+	cache.FlushAll()
+	assert(t, len(cache.Entries()), 0)
+}
+
+func TestResourceCacheCredibility(t *testing.T) {
+	cache := NewSharedResourceCache()
+	record := func(addr byte) []RR {
+		return []RR{{RR_Header: RR_Header{Name: "ns1.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 300}, Data: &RR_A{Addr: [4]byte{192, 0, 2, addr}}}}
+	}
+
+	cache.Put("ns1.example.com", TYPE_A, record(1), CredibilityAdditional)
+	assert(t, cache.Get("ns1.example.com", TYPE_A)[0].Data.(*RR_A).Addr[3], byte(1))
+	// glue is only used to reach nameservers, never to answer clients
+	assert(t, cache.GetAnswer("ns1.example.com", TYPE_A) == nil, true)
+	assert(t, cache.GetStale("ns1.example.com", TYPE_A) == nil, true)
+
+	cache.Put("ns1.example.com", TYPE_A, record(2), CredibilityAuthoritativeAnswer)
+	assert(t, cache.GetAnswer("ns1.example.com", TYPE_A)[0].Data.(*RR_A).Addr[3], byte(2))
+	cache.Put("ns1.example.com", TYPE_A, record(3), CredibilityAdditional)
+	assert(t, cache.Get("ns1.example.com", TYPE_A)[0].Data.(*RR_A).Addr[3], byte(2))
+
+	cache.Put("ns1.example.com", TYPE_A, record(4), CredibilityAuthoritativeAnswer)
+	assert(t, cache.Get("ns1.example.com", TYPE_A)[0].Data.(*RR_A).Addr[3], byte(4))
+}
+
+func TestRRString(t *testing.T) {
+	a := &RR_A{Addr: [4]byte{192, 0, 2, 1}}
+	assert(t, a.String(), "192.0.2.1")
+	rr := RR{RR_Header: RR_Header{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 300}, Data: a}
+	assert(t, strings.Contains(rr.String(), "192.0.2.1"), true, rr.String())
+}
+
+func TestResourceCachePrefetch(t *testing.T) {
+	prefetches := 0
+	accept := true
+	cache := NewSharedResourceCacheWithConfig(ResourceCacheConfig{
+		PrefetchMinHits: 2,
+		Prefetch: func(domain string, ty uint16) bool {
+			prefetches += 1
+			return accept
+		},
+	})
+	cache.Put("www.example.com", TYPE_A, []RR{{RR_Header: RR_Header{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 100}, Data: &RR_A{}}}, CredibilityAnswer)
+
+	// not prefetched before the last 10% of the ttl
+	cache.Get("www.example.com", TYPE_A)
+	ageResourceCache(cache, 85*time.Second)
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 0)
+
+	// nor before the minimum number of hits
+	cache.Put("www.example.com", TYPE_A, []RR{{RR_Header: RR_Header{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 100}, Data: &RR_A{}}}, CredibilityAnswer)
+	ageResourceCache(cache, 91*time.Second)
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 0)
+
+	// once both are reached the entry is prefetched only once
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 1)
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 1)
+
+	// a skipped prefetch is tried again on the next hit
+	cache.Put("www.example.com", TYPE_A, []RR{{RR_Header: RR_Header{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN, TTL: 100}, Data: &RR_A{}}}, CredibilityAnswer)
+	ageResourceCache(cache, 91*time.Second)
+	accept = false
+	cache.Get("www.example.com", TYPE_A)
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 2)
+	accept = true
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 3)
+	cache.Get("www.example.com", TYPE_A)
+	assert(t, prefetches, 3)
+}
@@ -0,0 +1,41 @@
+package dns
+
+// the udp payload size advertised in the OPT record of responses
+const serverEdnsBufferSize = DefaultEdnsBufferSize
+
+// the extended response code of responses to queries with an unsupported EDNS version (RFC 6891 section 6.1.3).
+// the upper 8 bits are carried in the OPT record, the lower 4 in the header.
+const RCODE_BAD_VERSION uint8 = 16
+
+// the OPT record of a query (RFC 6891), nil if it has none. false if the additional section
+// has anything other than a single OPT record owned by the root.
+func queryOpt(msg *Message) (*RR, bool) {
+	if msg.Header.AdditionalCount != uint16(len(msg.Additional)) {
+		return nil, false
+	}
+	switch len(msg.Additional) {
+	case 0:
+		return nil, true
+	case 1:
+		opt := &msg.Additional[0]
+		if opt.Type != TYPE_OPT || opt.Name != rootZone {
+			return nil, false
+		}
+		return opt, true
+	default:
+		return nil, false
+	}
+}
+
+func ednsVersion(opt *RR) uint8 {
+	return uint8(opt.TTL >> 16)
+}
+
+// the OPT record of a response with the given extended response code, the options of the
+// query are not echoed
+func newOpt(rcode uint8) RR {
+	return RR{
+		RR_Header: RR_Header{Name: rootZone, Type: TYPE_OPT, Class: serverEdnsBufferSize, TTL: uint32(rcode>>4) << 24},
+		Data:      &RR_Unknown{},
+	}
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+var _ Transport = (*HttpsTransport)(nil)
+
+// HttpsTransport sends queries with dns over https (RFC 8484). the address given to Exchange is
+// the url of the endpoint, for example https://dns.example/dns-query.
+// connections are reused and http/2 is used if the server supports it.
+type HttpsTransport struct {
+	// defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Exchange implements Transport.
+// the query is sent with id 0 to make responses cacheable by http caches, the response is
+// returned with the id of msg.
+func (t *HttpsTransport) Exchange(ctx context.Context, msg *Message, url string) (*Message, error) {
+	query := *msg
+	query.Header.Id = 0
+	encoded, err := Encode(&query, MessageSizeLimitTCP)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		slog.Debug("failed to send dns over https request", "url", url, "error", err)
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns over https request to %v failed: %v", url, httpResp.Status)
+	}
+	if contentType := httpResp.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("dns over https response from %v has unexpected content type %q", url, contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxDohMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDohMessageSize {
+		return nil, fmt.Errorf("dns over https response from %v is too large", url)
+	}
+
+	resp, err := Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(&query, resp); err != nil {
+		return nil, err
+	}
+	resp.Header.Id = msg.Header.Id
+	return resp, nil
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ LameCache = (*SharedLameCache)(nil)
+
+const defaultLameMinTTL = time.Minute
+const defaultLameMaxTTL = time.Hour
+
+// server failures can be transient, a delegation is only lame once it fails this many times
+// with less than the minimum lame ttl between failures
+const lameServerFailures = 3
+
+type LameReason uint8
+
+const (
+	LameReasonRefused LameReason = iota
+	LameReasonServerFailure
+	LameReasonNotAuthoritative
+	LameReasonUpwardReferral
+)
+
+func (r LameReason) String() string {
+	switch r {
+	case LameReasonRefused:
+		return "refused"
+	case LameReasonServerFailure:
+		return "server failure"
+	case LameReasonNotAuthoritative:
+		return "not authoritative"
+	case LameReasonUpwardReferral:
+		return "upward referral"
+	default:
+		return "unknown"
+	}
+}
+
+// LameDelegation is a nameserver that is delegated a zone but does not serve it correctly.
+type LameDelegation struct {
+	Zone       string
+	Nameserver string
+	Reason     LameReason
+	// number of consecutive times the delegation was found to be lame
+	Strikes int
+	Expires time.Time
+}
+
+// LameCache keeps track of lame (zone, nameserver) pairs so they can be skipped during resolution.
+type LameCache interface {
+	IsLame(zone string, nameserver string) bool
+	MarkLame(zone string, nameserver string, reason LameReason)
+	// record a server failure, the delegation is marked lame after repeated failures.
+	// returns true if it was marked lame.
+	MarkServerFailure(zone string, nameserver string) bool
+	Entries() []LameDelegation
+}
+
+type lameCacheKey struct {
+	zone       string
+	nameserver string
+}
+
+// the recent server failures of a delegation that is not lame yet
+type serverFailures struct {
+	count int
+	last  time.Time
+}
+
+type SharedLameCache struct {
+	sync.Mutex
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	entries  map[lameCacheKey]LameDelegation
+	failures map[lameCacheKey]serverFailures
+}
+
+func NewSharedLameCache() *SharedLameCache {
+	return &SharedLameCache{
+		Mutex:    sync.Mutex{},
+		minTTL:   defaultLameMinTTL,
+		maxTTL:   defaultLameMaxTTL,
+		entries:  make(map[lameCacheKey]LameDelegation),
+		failures: make(map[lameCacheKey]serverFailures),
+	}
+}
+
+func newLameCacheKey(zone string, nameserver string) lameCacheKey {
+	return lameCacheKey{
+		zone:       strings.ToLower(zone),
+		nameserver: strings.ToLower(nameserver),
+	}
+}
+
+// IsLame implements LameCache.
+func (s *SharedLameCache) IsLame(zone string, nameserver string) bool {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.entries[newLameCacheKey(zone, nameserver)]
+	return ok && time.Now().Before(entry.Expires)
+}
+
+// MarkLame implements LameCache.
+// the time a delegation is considered lame doubles every time it is found to be lame again
+// shortly after the previous entry expired.
+func (s *SharedLameCache) MarkLame(zone string, nameserver string, reason LameReason) {
+	s.Lock()
+	defer s.Unlock()
+	s.markLameLocked(zone, nameserver, reason)
+}
+
+// MarkServerFailure implements LameCache.
+// failures more than the minimum lame ttl apart are not counted as repeated.
+func (s *SharedLameCache) MarkServerFailure(zone string, nameserver string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	key := newLameCacheKey(zone, nameserver)
+	failures := s.failures[key]
+	if now.Sub(failures.last) >= s.minTTL {
+		failures.count = 0
+	}
+	failures.count += 1
+	failures.last = now
+
+	// forget about failures that are too old to be repeated
+	for k, f := range s.failures {
+		if now.Sub(f.last) >= s.minTTL {
+			delete(s.failures, k)
+		}
+	}
+
+	if failures.count < lameServerFailures {
+		s.failures[key] = failures
+		return false
+	}
+	delete(s.failures, key)
+	s.markLameLocked(zone, nameserver, LameReasonServerFailure)
+	return true
+}
+
+func (s *SharedLameCache) markLameLocked(zone string, nameserver string, reason LameReason) {
+	now := time.Now()
+	key := newLameCacheKey(zone, nameserver)
+	strikes := 1
+	if entry, ok := s.entries[key]; ok && now.Before(entry.Expires.Add(s.maxTTL)) {
+		strikes = entry.Strikes + 1
+	}
+
+	ttl := s.minTTL
+	for i := 1; i < strikes && ttl < s.maxTTL; i++ {
+		ttl *= 2
+	}
+	ttl = min(ttl, s.maxTTL)
+
+	s.entries[key] = LameDelegation{
+		Zone:       zone,
+		Nameserver: nameserver,
+		Reason:     reason,
+		Strikes:    strikes,
+		Expires:    now.Add(ttl),
+	}
+
+	// forget about entries that expired long enough ago that their strikes would be reset
+	for k, entry := range s.entries {
+		if now.After(entry.Expires.Add(s.maxTTL)) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// Entries implements LameCache.
+// returns the delegations that are currently considered lame, sorted by zone.
+func (s *SharedLameCache) Entries() []LameDelegation {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	entries := make([]LameDelegation, 0)
+	for _, entry := range s.entries {
+		if now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b LameDelegation) int {
+		if c := strings.Compare(a.Zone, b.Zone); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Nameserver, b.Nameserver)
+	})
+	return entries
+}
@@ -0,0 +1,63 @@
+package dns
+
+import "fmt"
+
+var ErrRecursionLimitExceeded = fmt.Errorf("recursion limit exceeded")
+
+// RecursionLimits bound the amount of work done to answer a single client query.
+// they protect against delegations crafted to amplify one query into many upstream queries (NXNS).
+type RecursionLimits struct {
+	// maximum number of referrals followed while resolving a single name
+	MaxReferralDepth int
+	// maximum number of queries sent to authoritative servers
+	MaxUpstreamQueries int
+	// maximum number of nameserver names that had to be resolved because no glue was available
+	MaxGluelessLookups int
+	// maximum number of CNAMEs followed
+	MaxCNAMEChain int
+}
+
+func DefaultRecursionLimits() RecursionLimits {
+	return RecursionLimits{
+		MaxReferralDepth:   16,
+		MaxUpstreamQueries: 64,
+		MaxGluelessLookups: 8,
+		MaxCNAMEChain:      8,
+	}
+}
+
+func (l *RecursionLimits) validate() error {
+	if l.MaxReferralDepth <= 0 || l.MaxUpstreamQueries <= 0 || l.MaxGluelessLookups <= 0 || l.MaxCNAMEChain <= 0 {
+		return fmt.Errorf("invalid recursion limits: all limits must be positive: %+v", *l)
+	}
+	return nil
+}
+
+// the work done so far while answering a single client query
+type resolveState struct {
+	limits          *RecursionLimits
+	visitedCNAMEs   map[string]struct{}
+	upstreamQueries int
+	gluelessLookups int
+	cnameChain      int
+}
+
+func newResolveState(limits *RecursionLimits) *resolveState {
+	return &resolveState{
+		limits:        limits,
+		visitedCNAMEs: make(map[string]struct{}),
+	}
+}
+
+// increment the counter, failing if that exceeds the limit
+func (s *resolveState) spend(counter *int, limit int, what string) error {
+	if *counter >= limit {
+		return s.exceeded(what, limit)
+	}
+	*counter += 1
+	return nil
+}
+
+func (s *resolveState) exceeded(what string, limit int) error {
+	return fmt.Errorf("%w: %v (limit %v)", ErrRecursionLimitExceeded, what, limit)
+}
@@ -0,0 +1,711 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolverConfig configures a Resolver. zero values are replaced by the defaults.
+type ResolverConfig struct {
+	// root nameservers used to bootstrap recursion, defaults to DefaultRootHints
+	RootHints *RootHints
+	// address family used to contact nameservers
+	AddressFamily AddressFamily
+	// how often the root nameservers are refreshed with a priming query
+	RootPrimingInterval time.Duration
+	// defaults to DefaultRecursionLimits
+	RecursionLimits RecursionLimits
+	// answer with stale records when resolution fails or takes longer than StaleAnswerTimeout.
+	// the resource cache must be configured with a StaleWindow for stale records to be kept.
+	ServeStale         bool
+	StaleAnswerTimeout time.Duration
+	// used for all upstream queries, defaults to a TcpPool
+	Transport Transport
+	// forward queries to these recursive servers, in order, instead of resolving them from the root
+	Forwarders []*Upstream
+	// caches shared by every query, new caches are created if nil
+	AuthorityCache AuthorityCache
+	ResourceCache  ResourceCache
+	LameCache      LameCache
+}
+
+// Resolver answers queries by recursively querying the authoritative nameservers, starting at the root,
+// or by forwarding them to upstream recursive servers. it is safe for concurrent use.
+type Resolver struct {
+	config ResolverConfig
+
+	// serve-stale resolutions in progress, shared by the queries for the same question
+	inflightMu sync.Mutex
+	inflight   map[resourceCacheKey]*inflightResolution
+}
+
+func NewResolver(config ResolverConfig) (*Resolver, error) {
+	if config.RootHints == nil {
+		config.RootHints = DefaultRootHints()
+	}
+	switch config.AddressFamily {
+	case AddressFamilyAny, AddressFamilyIpv4, AddressFamilyIpv6:
+	default:
+		return nil, fmt.Errorf("invalid address family: %v", config.AddressFamily)
+	}
+	if config.RootPrimingInterval == 0 {
+		config.RootPrimingInterval = defaultRootPrimingInterval
+	}
+	if config.RecursionLimits == (RecursionLimits{}) {
+		config.RecursionLimits = DefaultRecursionLimits()
+	}
+	if err := config.RecursionLimits.validate(); err != nil {
+		return nil, err
+	}
+	if config.StaleAnswerTimeout == 0 {
+		config.StaleAnswerTimeout = defaultStaleAnswerTimeout
+	}
+	if config.Transport == nil {
+		config.Transport = &TcpPool{}
+	}
+	if config.AuthorityCache == nil {
+		config.AuthorityCache = NewSharedAuthorityCache()
+	}
+	if config.ResourceCache == nil {
+		config.ResourceCache = NewSharedResourceCache()
+	}
+	if config.LameCache == nil {
+		config.LameCache = NewSharedLameCache()
+	}
+	return &Resolver{config: config, inflight: make(map[resourceCacheKey]*inflightResolution)}, nil
+}
+
+// release the resources held by the transport, if it implements io.Closer, and the forwarders
+func (r *Resolver) Close() error {
+	for _, upstream := range r.config.Forwarders {
+		upstream.Close()
+	}
+	if closer, ok := r.config.Transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// resolve a single question, returning the response a recursive server would send.
+func (r *Resolver) Resolve(ctx context.Context, name string, ty uint16, class uint16) (*Message, error) {
+	msg := newQuery(name, ty)
+	msg.Header.RecursionDesired = true
+	msg.Questions[0].Class = class
+	return r.Exchange(ctx, msg)
+}
+
+// answer a query message. malformed or unsupported queries are answered with the appropriate
+// error response, an error is only returned if the resolution itself fails.
+func (r *Resolver) Exchange(ctx context.Context, msg *Message) (*Message, error) {
+	return r.exchange(ctx, msg, false)
+}
+
+// answer a query message, only from the cache if cacheOnly is set. queries that are not
+// cached are then refused.
+func (r *Resolver) exchange(ctx context.Context, msg *Message, cacheOnly bool) (*Message, error) {
+	if msg.Header.Response {
+		slog.Warn("received message with response flag set")
+		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR), nil
+	}
+
+	if msg.Header.Opcode != OPCODE_QUERY {
+		slog.Warn("received message with opcode != OPCODE_QUERY", "opcode", msg.Header.Opcode)
+		return createErrorResponseMessage(msg, RCODE_NOT_IMPLEMENTED), nil
+	}
+
+	if msg.Header.QuestionCount != 1 || len(msg.Questions) != 1 {
+		slog.Warn("received message with incorrect number of questions", "questions", msg.Header.QuestionCount)
+		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR), nil
+	}
+
+	if msg.Header.AnswerCount != 0 || msg.Header.AuthoritativeCount != 0 {
+		slog.Warn("received message with resource records")
+		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR), nil
+	}
+
+	opt, ok := queryOpt(msg)
+	if !ok {
+		slog.Warn("received message with additional records other than a single OPT record")
+		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR), nil
+	}
+	if opt != nil && ednsVersion(opt) != 0 {
+		slog.Debug("received message with unsupported EDNS version", "version", ednsVersion(opt))
+		response := createErrorResponseMessage(msg, RCODE_NO_ERROR)
+		response.Additional = []RR{newOpt(RCODE_BAD_VERSION)}
+		response.Header.AdditionalCount = 1
+		return response, nil
+	}
+
+	question := msg.Questions[0]
+
+	if question.Class != CLASS_IN {
+		slog.Warn("received message with question class != CLASS_IN", "class", question.Class)
+		return createErrorResponseMessage(msg, RCODE_NOT_IMPLEMENTED), nil
+	}
+
+	var res *resolution
+	if cacheOnly {
+		res, _, _ = r.lookupCache(question.Name, question.Type, false)
+		if res == nil {
+			return createErrorResponseMessage(msg, RCODE_REFUSED), nil
+		}
+	} else {
+		var err error
+		res, err = r.resolveQuestion(ctx, question)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response := &Message{}
+	response.Header.Id = msg.Header.Id
+	response.Header.Response = true
+	response.Header.RecursionAvailable = true
+	response.Header.RecursionDesired = msg.Header.RecursionDesired
+	response.Header.ResponseCode = res.rcode
+	response.Header.QuestionCount = msg.Header.QuestionCount
+	response.Header.AnswerCount = uint16(len(res.answers))
+	response.Header.AuthoritativeCount = uint16(len(res.authority))
+	response.Questions = msg.Questions
+	response.Answers = res.answers
+	response.Authority = res.authority
+	if opt != nil {
+		response.Additional = []RR{newOpt(RCODE_NO_ERROR)}
+		response.Header.AdditionalCount = 1
+	}
+	return response, nil
+}
+
+// the outcome of resolving a name
+type resolution struct {
+	rcode   uint8
+	answers []RR
+	// the SOA record of the zone for negative answers
+	authority []RR
+}
+
+func positiveResolution(answers []RR) *resolution {
+	return &resolution{rcode: RCODE_NO_ERROR, answers: answers}
+}
+
+type resolveResult struct {
+	res *resolution
+	err error
+}
+
+// a resolution running in its own goroutine, result is set once done is closed
+type inflightResolution struct {
+	done   chan struct{}
+	result resolveResult
+}
+
+// join the resolution of the question in progress or start a new one. at most one resolution
+// runs per question, so queries answered with stale records do not each leave a resolution
+// running in the background.
+func (r *Resolver) joinResolution(ctx context.Context, question Question) *inflightResolution {
+	key := resourceCacheKey{domain: question.Name, ty: question.Type}
+
+	r.inflightMu.Lock()
+	defer r.inflightMu.Unlock()
+	if flight, ok := r.inflight[key]; ok {
+		return flight
+	}
+
+	flight := &inflightResolution{done: make(chan struct{})}
+	r.inflight[key] = flight
+	go func() {
+		res, err := r.resolve(ctx, question.Name, question.Type, newResolveState(&r.config.RecursionLimits))
+		flight.result = resolveResult{res: res, err: err}
+		r.inflightMu.Lock()
+		delete(r.inflight, key)
+		r.inflightMu.Unlock()
+		close(flight.done)
+	}()
+	return flight
+}
+
+// resolve the question, falling back to stale records from the cache if serve-stale is
+// enabled and the resolution fails or takes longer than the stale answer timeout.
+// in the latter case the resolution continues in the background and refreshes the cache.
+func (r *Resolver) resolveQuestion(ctx context.Context, question Question) (*resolution, error) {
+	if !r.config.ServeStale {
+		return r.resolve(ctx, question.Name, question.Type, newResolveState(&r.config.RecursionLimits))
+	}
+
+	flight := r.joinResolution(ctx, question)
+
+	timer := time.NewTimer(r.config.StaleAnswerTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-flight.done:
+	case <-timer.C:
+		if stale, _, _ := r.lookupCache(question.Name, question.Type, true); stale != nil {
+			slog.Debug("resolution is taking too long, answering with stale records", "name", question.Name, "type", typeToString(question.Type))
+			return stale, nil
+		}
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	result := flight.result
+
+	if result.err != nil {
+		if stale, _, _ := r.lookupCache(question.Name, question.Type, true); stale != nil {
+			slog.Info("resolution failed, answering with stale records", "name", question.Name, "type", typeToString(question.Type), "error", result.err)
+			return stale, nil
+		}
+	}
+
+	return result.res, result.err
+}
+
+// refresh a cached entry by resolving it again, even if it has not expired yet
+func (r *Resolver) prefetch(ctx context.Context, name string, ty uint16) {
+	slog.Debug("prefetching", "name", name, "type", typeToString(ty))
+	if _, err := r.resolveUncached(ctx, name, ty, newResolveState(&r.config.RecursionLimits)); err != nil {
+		slog.Debug("failed to prefetch", "name", name, "type", typeToString(ty), "error", err)
+	}
+}
+
+// resolve the name following CNAMEs if necessary
+func (r *Resolver) resolve(ctx context.Context, name string, ty uint16, state *resolveState) (*resolution, error) {
+	res, chain, next := r.lookupCache(name, ty, false)
+	if res != nil {
+		return res, nil
+	}
+
+	// part of the cname chain is cached, continue from where it ends
+	if len(chain) != 0 {
+		return r.followCNAME(ctx, chain, next, ty, state)
+	}
+
+	if rrs := r.config.RootHints.addressRRs(name, ty); rrs != nil {
+		return positiveResolution(rrs), nil
+	}
+
+	res, err := r.resolveUncached(ctx, name, ty, state)
+	if err != nil {
+		return nil, err
+	}
+	// answer from the cache so the first answer has the same clamped ttls as the ones that follow.
+	// records that were not cached, like those with a ttl of zero, are answered as received.
+	if cached, _, _ := r.lookupCache(name, ty, false); cached != nil {
+		return cached, nil
+	}
+	return res, nil
+}
+
+// follow the cname chain of name through the cache, each RRset keeps its own ttl.
+// returns the resolution if the chain ends in a cached answer, otherwise the cnames
+// found so far and the name the chain continues at. glue and the authority section of
+// referrals are not credible enough to answer with (RFC 2181 section 5.4.1).
+func (r *Resolver) lookupCache(name string, ty uint16, allowStale bool) (*resolution, []RR, string) {
+	get := r.config.ResourceCache.GetAnswer
+	if allowStale {
+		get = r.config.ResourceCache.GetStale
+	}
+
+	chain := make([]RR, 0)
+	visited := make(map[string]struct{})
+	for {
+		if rrs := get(name, ty); rrs != nil {
+			return positiveResolution(append(chain, rrs...)), nil, ""
+		}
+
+		if rcode, soa, ok := r.config.ResourceCache.GetNegative(name, ty); ok {
+			return &resolution{rcode: rcode, answers: chain, authority: soa}, nil, ""
+		}
+
+		if ty == TYPE_CNAME {
+			return nil, chain, name
+		}
+
+		cname := get(name, TYPE_CNAME)
+		if len(cname) == 0 {
+			return nil, chain, name
+		}
+
+		visited[name] = struct{}{}
+		chain = append(chain, cname[0])
+		name = cname[0].Data.(*RR_CNAME).CNAME
+		if _, loop := visited[name]; loop {
+			return positiveResolution(chain), nil, ""
+		}
+	}
+}
+
+// continue resolving a cname chain at target, the resolution answers are prefixed with chain
+func (r *Resolver) followCNAME(ctx context.Context, chain []RR, target string, ty uint16, state *resolveState) (*resolution, error) {
+	for _, rr := range chain {
+		state.visitedCNAMEs[strings.ToLower(rr.Name)] = struct{}{}
+	}
+	key := strings.ToLower(target)
+	if _, visited := state.visitedCNAMEs[key]; visited {
+		slog.Debug("cname loop", "cname", target)
+		return positiveResolution(chain), nil
+	}
+	state.visitedCNAMEs[key] = struct{}{}
+
+	if err := state.spend(&state.cnameChain, state.limits.MaxCNAMEChain, "cname chain length"); err != nil {
+		return nil, err
+	}
+
+	res, err := r.resolve(ctx, target, ty, state)
+	if err != nil {
+		slog.Warn("failed to resolve cname", "cname", target, "error", err)
+		return nil, err
+	}
+
+	// the response code and authority are those of the end of the chain
+	answers := make([]RR, 0, len(chain)+len(res.answers))
+	answers = append(answers, chain...)
+	answers = append(answers, res.answers...)
+	return &resolution{rcode: res.rcode, answers: answers, authority: res.authority}, nil
+}
+
+// build the answer for name from the answer section of a response, following cnames.
+// only records at or below zone are used. returns the records found, the name the
+// chain continues at and if the chain ended in records of the requested type.
+func answerChain(zone string, name string, ty uint16, answers []RR) ([]RR, string, bool) {
+	chain := make([]RR, 0)
+	for i := 0; i <= len(answers); i++ {
+		var cname *RR
+		matched := make([]RR, 0)
+		for idx, rr := range answers {
+			if !nameEq(rr.Name, name) || !isSubdomainOf(rr.Name, zone) {
+				continue
+			}
+			if rr.Type == ty {
+				matched = append(matched, rr)
+			} else if rr.Type == TYPE_CNAME && cname == nil {
+				cname = &answers[idx]
+			}
+		}
+
+		if len(matched) != 0 {
+			return append(chain, matched...), "", true
+		}
+		if cname == nil {
+			break
+		}
+		chain = append(chain, *cname)
+		name = cname.Data.(*RR_CNAME).CNAME
+	}
+	return chain, name, false
+}
+
+// the negative resolution of an authoritative response, cached for name if it has an SOA record
+func (r *Resolver) negativeResolution(name string, ty uint16, resp *Message) *resolution {
+	res := &resolution{rcode: resp.Header.ResponseCode}
+	for _, rr := range resp.Authority {
+		if rr.Type == TYPE_SOA {
+			res.authority = append(res.authority, rr)
+		}
+	}
+	if len(res.authority) != 0 {
+		r.config.ResourceCache.PutNegative(name, ty, res.rcode, res.authority)
+	}
+	return res
+}
+
+func (r *Resolver) resolveUncached(ctx context.Context, name string, ty uint16, state *resolveState) (*resolution, error) {
+	if len(r.config.Forwarders) != 0 {
+		return r.forward(ctx, name, ty, state)
+	}
+
+	// find the best nameservers and use the slice as a queue
+	nameservers := findBestAuthorities(r.config.AuthorityCache, r.config.RootHints, name)
+
+	referrals := 0
+	responded := false
+	// the recursion limit hit while looking up the address of a nameserver, the remaining
+	// nameservers are still tried and it is only returned if none of them answers
+	var limitErr error
+	for {
+		if len(nameservers) == 0 {
+			break
+		}
+
+		authority := nameservers[len(nameservers)-1]
+		nameservers = nameservers[:len(nameservers)-1]
+		if r.config.LameCache.IsLame(authority.zone, authority.nameserver) {
+			slog.Debug("skipping lame nameserver", "zone", authority.zone, "nameserver", authority.nameserver)
+			continue
+		}
+
+		sockaddrs, err := r.resolveNameserverAddrs(ctx, authority, state)
+		if errors.Is(err, ErrRecursionLimitExceeded) {
+			slog.Debug("skipping nameserver", "zone", authority.zone, "nameserver", authority.nameserver, "error", err)
+			limitErr = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(sockaddrs) == 0 {
+			continue
+		}
+
+		if err := state.spend(&state.upstreamQueries, state.limits.MaxUpstreamQueries, "upstream queries"); err != nil {
+			return nil, err
+		}
+		resp, err := requestAny(ctx, r.config.Transport, sockaddrs, name, ty)
+		if err != nil {
+			slog.Warn("failed to request", "error", err, "nameserver", authority.nameserver)
+			continue
+		}
+		responded = true
+
+		if resp.Header.ResponseCode == RCODE_SERVER_FAILURE {
+			slog.Debug("server failure", "zone", authority.zone, "nameserver", authority.nameserver)
+			if r.config.LameCache.MarkServerFailure(authority.zone, authority.nameserver) {
+				slog.Info("lame delegation", "zone", authority.zone, "nameserver", authority.nameserver, "reason", LameReasonServerFailure)
+			}
+			continue
+		}
+
+		if reason, lame := checkLameResponse(authority.zone, name, resp); lame {
+			slog.Info("lame delegation", "zone", authority.zone, "nameserver", authority.nameserver, "reason", reason)
+			r.config.LameCache.MarkLame(authority.zone, authority.nameserver, reason)
+			continue
+		}
+
+		cacheResponse(r.config.ResourceCache, authority.zone, resp)
+
+		if len(resp.Answers) != 0 {
+			chain, next, answered := answerChain(authority.zone, name, ty, resp.Answers)
+			if answered {
+				return positiveResolution(chain), nil
+			}
+			if len(chain) == 0 {
+				slog.Debug("response answers do not match the question", "nameserver", authority.nameserver, "name", name)
+				continue
+			}
+			// the chain ends in a name of the same zone that the server says does not exist or has no records
+			if resp.Header.Authoritative && isSubdomainOf(next, authority.zone) {
+				res := r.negativeResolution(next, ty, resp)
+				res.answers = chain
+				return res, nil
+			}
+			return r.followCNAME(ctx, chain, next, ty, state)
+		}
+
+		// authoritative response without answers, the name or type does not exist
+		if resp.Header.Authoritative {
+			return r.negativeResolution(name, ty, resp), nil
+		}
+
+		zoneAuthoritiesMinTTL := uint32(math.MaxUint32)
+		zoneAuthorities := make(map[string][]string)
+		for _, rr := range resp.Authority {
+			if rr_ns, ok := rr.Data.(*RR_NS); ok {
+				zoneAuthorities[rr.Name] = append(zoneAuthorities[rr.Name], rr_ns.Nameserver)
+				zoneAuthoritiesMinTTL = min(zoneAuthoritiesMinTTL, rr.TTL)
+			}
+		}
+
+		if len(zoneAuthorities) != 0 {
+			referrals += 1
+			if referrals > state.limits.MaxReferralDepth {
+				return nil, state.exceeded("referral depth", state.limits.MaxReferralDepth)
+			}
+		}
+
+		for zone, zoneNameservers := range zoneAuthorities {
+			r.config.AuthorityCache.Put(zone, zoneNameservers, zoneAuthoritiesMinTTL)
+			for _, nameserver := range zoneNameservers {
+				nameservers = append(nameservers, authorityServer{zone: zone, nameserver: nameserver})
+			}
+		}
+	}
+
+	if limitErr != nil {
+		return nil, limitErr
+	}
+	if !responded {
+		return nil, ErrNoResponse
+	}
+	// the nameservers that responded were lame or their responses could not be used
+	return nil, ErrZoneUnreachable
+}
+
+// ask the forwarders in order until one of them answers. the forwarders follow cnames themselves,
+// a chain that does not end in an answer is treated as a negative answer for its last name.
+func (r *Resolver) forward(ctx context.Context, name string, ty uint16, state *resolveState) (*resolution, error) {
+	for _, upstream := range r.config.Forwarders {
+		if err := state.spend(&state.upstreamQueries, state.limits.MaxUpstreamQueries, "upstream queries"); err != nil {
+			return nil, err
+		}
+
+		query := newQuery(name, ty)
+		query.Header.RecursionDesired = true
+		resp, err := upstream.Exchange(ctx, query)
+		if err != nil {
+			slog.Warn("failed to forward query", "upstream", upstream, "name", name, "error", err)
+			continue
+		}
+		if err := validateResponse(query, resp); err != nil {
+			slog.Warn("invalid response from upstream", "upstream", upstream, "name", name, "error", err)
+			continue
+		}
+		switch resp.Header.ResponseCode {
+		case RCODE_NO_ERROR, RCODE_NAME_ERROR:
+		default:
+			slog.Debug("upstream failed to answer", "upstream", upstream, "name", name, "rcode", resp.Header.ResponseCode)
+			continue
+		}
+
+		cacheResponse(r.config.ResourceCache, rootZone, resp)
+		chain, next, answered := answerChain(rootZone, name, ty, resp.Answers)
+		if answered {
+			return positiveResolution(chain), nil
+		}
+		if len(chain) == 0 {
+			next = name
+		}
+		res := r.negativeResolution(next, ty, resp)
+		res.answers = chain
+		return res, nil
+	}
+	return nil, ErrNoResponse
+}
+
+// check if the response shows that the nameserver does not correctly serve the zone it was delegated.
+// server failures can be transient and are not checked here.
+func checkLameResponse(zone string, name string, resp *Message) (LameReason, bool) {
+	switch resp.Header.ResponseCode {
+	case RCODE_REFUSED:
+		return LameReasonRefused, true
+	}
+
+	if resp.Header.Authoritative {
+		return 0, false
+	}
+
+	if len(resp.Answers) != 0 {
+		return LameReasonNotAuthoritative, true
+	}
+
+	// a referral must point to a zone below the delegated zone that encloses the name
+	for _, rr := range resp.Authority {
+		if rr.Type != TYPE_NS {
+			continue
+		}
+		if !isSubdomainOf(rr.Name, zone) || nameEq(rr.Name, zone) || !isSubdomainOf(name, rr.Name) {
+			return LameReasonUpwardReferral, true
+		}
+	}
+
+	return 0, false
+}
+
+// resolve the addresses of a nameserver for the configured address families.
+// addresses already in the cache (usually glue) are preferred over new lookups, which are
+// only done if none of the cached addresses can be used with the configured address families.
+// a nameserver inside the zone it serves can only be found through that zone, without cached
+// addresses it is skipped so the delegation is fetched again from the parent zone with its glue.
+func (r *Resolver) resolveNameserverAddrs(ctx context.Context, authority authorityServer, state *resolveState) ([]sockAddr, error) {
+	nameserver := authority.nameserver
+	types := r.config.AddressFamily.recordTypes()
+
+	rrs := make([]RR, 0)
+	for _, ty := range types {
+		if cached := r.config.ResourceCache.Get(nameserver, ty); cached != nil {
+			rrs = append(rrs, cached...)
+		} else if hinted := r.config.RootHints.addressRRs(nameserver, ty); hinted != nil {
+			rrs = append(rrs, hinted...)
+		}
+	}
+	if sockaddrs := r.usableAddrs(rrs); len(sockaddrs) != 0 {
+		return sockaddrs, nil
+	}
+
+	if isSubdomainOf(nameserver, authority.zone) {
+		slog.Debug("in-bailiwick nameserver without addresses, falling back to the parent zone", "zone", authority.zone, "nameserver", nameserver)
+		return nil, nil
+	}
+
+	if err := state.spend(&state.gluelessLookups, state.limits.MaxGluelessLookups, "glueless nameserver lookups"); err != nil {
+		return nil, err
+	}
+	var limitErr error
+	for _, ty := range types {
+		nsres, err := r.resolve(ctx, nameserver, ty, state)
+		if errors.Is(err, ErrRecursionLimitExceeded) {
+			limitErr = err
+			continue
+		}
+		if err != nil {
+			slog.Debug("failed to resolve nameserver address", "nameserver", nameserver, "type", typeToString(ty), "error", err)
+			continue
+		}
+		rrs = append(rrs, nsres.answers...)
+	}
+
+	sockaddrs := r.usableAddrs(rrs)
+	if len(sockaddrs) == 0 && limitErr != nil {
+		return nil, limitErr
+	}
+	return sockaddrs, nil
+}
+
+// the addresses of the records that can be reached with the configured address families
+func (r *Resolver) usableAddrs(rrs []RR) []sockAddr {
+	sockaddrs := make([]sockAddr, 0)
+	for _, ip := range extractIpsFromRRs(rrs) {
+		addr := sockAddr{Ip: ip, Port: 53}
+		if r.config.AddressFamily.allows(addr) {
+			sockaddrs = append(sockaddrs, addr)
+		}
+	}
+	return sockaddrs
+}
+
+// cache every RRset of the response under its owner name, ranked by the section it came from.
+// only records at or below the zone the nameserver was queried for are cached, the nameserver
+// is not trusted for other names.
+func cacheResponse(cache ResourceCache, zone string, resp *Message) {
+	answerCredibility := CredibilityAnswer
+	authorityCredibility := CredibilityAuthority
+	if resp.Header.Authoritative {
+		answerCredibility = CredibilityAuthoritativeAnswer
+		authorityCredibility = CredibilityAuthoritativeAuthority
+	}
+	putRRsets(cache, zone, resp.Answers, answerCredibility)
+	putRRsets(cache, zone, resp.Authority, authorityCredibility)
+	putRRsets(cache, zone, resp.Additional, CredibilityAdditional)
+}
+
+// cache the records grouped by owner name and type, ignoring records outside of zone
+func putRRsets(cache ResourceCache, zone string, rrs []RR, credibility Credibility) {
+	type key struct {
+		name string
+		ty   uint16
+	}
+	grouped := make(map[key][]RR)
+	order := make([]key, 0)
+	for _, rr := range rrs {
+		if rr.Type == TYPE_OPT || !isSubdomainOf(rr.Name, zone) {
+			continue
+		}
+		k := key{name: rr.Name, ty: rr.Type}
+		if _, ok := grouped[k]; !ok {
+			order = append(order, k)
+		}
+		grouped[k] = append(grouped[k], rr)
+	}
+	for _, k := range order {
+		cache.Put(k.name, k.ty, grouped[k], credibility)
+	}
+}
@@ -0,0 +1,765 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ Transport = (*fakeNetwork)(nil)
+
+// fakeNetwork is an in-memory Transport that routes queries to fake authoritative servers
+type fakeNetwork struct {
+	sync.Mutex
+	servers map[string]*fakeServer
+	queries map[string]int
+}
+
+// fakeServer answers authoritatively for its zones, referring queries below a delegation
+type fakeServer struct {
+	zones    map[string][]RR
+	down     bool
+	refused  bool
+	servfail bool
+	// how long the server takes to answer
+	delay time.Duration
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		servers: make(map[string]*fakeServer),
+		queries: make(map[string]int),
+	}
+}
+
+// serve the zone, given in master file format, from the servers at the given ips
+func (n *fakeNetwork) addZone(t testing.TB, origin string, text string, ips ...string) {
+	rrs, err := parseZone(strings.NewReader(text), origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range ips {
+		addr := ip + ":53"
+		server, ok := n.servers[addr]
+		if !ok {
+			server = &fakeServer{zones: make(map[string][]RR)}
+			n.servers[addr] = server
+		}
+		server.zones[zoneName(origin, rootZone)] = rrs
+	}
+}
+
+func (n *fakeNetwork) server(ip string) *fakeServer {
+	return n.servers[ip+":53"]
+}
+
+func (n *fakeNetwork) queriesTo(ip string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.queries[ip+":53"]
+}
+
+func (n *fakeNetwork) totalQueries() int {
+	n.Lock()
+	defer n.Unlock()
+	total := 0
+	for _, count := range n.queries {
+		total += count
+	}
+	return total
+}
+
+// Exchange implements Transport.
+func (n *fakeNetwork) Exchange(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	n.Lock()
+	server, ok := n.servers[addr]
+	n.queries[addr] += 1
+	n.Unlock()
+	if !ok || server.down {
+		return nil, fmt.Errorf("connection refused: %v", addr)
+	}
+	select {
+	case <-time.After(server.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	resp := server.answer(msg)
+	resp.Header.QuestionCount = uint16(len(resp.Questions))
+	resp.Header.AnswerCount = uint16(len(resp.Answers))
+	resp.Header.AuthoritativeCount = uint16(len(resp.Authority))
+	resp.Header.AdditionalCount = uint16(len(resp.Additional))
+
+	// go through the wire format like a real server would
+	encoded, err := Encode(resp, MessageSizeLimitTCP)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(encoded)
+}
+
+func (s *fakeServer) answer(msg *Message) *Message {
+	question := msg.Questions[0]
+	resp := &Message{Questions: msg.Questions}
+	resp.Header.Id = msg.Header.Id
+	resp.Header.Response = true
+
+	origin, ok := s.zoneFor(question.Name)
+	if !ok || s.refused {
+		resp.Header.ResponseCode = RCODE_REFUSED
+		return resp
+	}
+	if s.servfail {
+		resp.Header.ResponseCode = RCODE_SERVER_FAILURE
+		return resp
+	}
+	zone := s.zones[origin]
+
+	if cut, ok := delegation(origin, zone, question.Name); ok {
+		for _, rr := range zone {
+			if rr.Type == TYPE_NS && nameEq(rr.Name, cut) {
+				resp.Authority = append(resp.Authority, rr)
+				resp.Additional = append(resp.Additional, recordsOf(zone, rr.Data.(*RR_NS).Nameserver, TYPE_A, TYPE_AAAA)...)
+			}
+		}
+		return resp
+	}
+
+	resp.Header.Authoritative = true
+	name := question.Name
+	for isSubdomainOf(name, origin) {
+		if rrs := recordsOf(zone, name, question.Type); len(rrs) != 0 {
+			resp.Answers = append(resp.Answers, rrs...)
+			return resp
+		}
+		cname := recordsOf(zone, name, TYPE_CNAME)
+		if len(cname) == 0 || len(resp.Answers) > 8 {
+			break
+		}
+		resp.Answers = append(resp.Answers, cname[0])
+		name = cname[0].Data.(*RR_CNAME).CNAME
+	}
+	if !isSubdomainOf(name, origin) {
+		return resp
+	}
+
+	// the name exists if it owns records or has names below it (empty non-terminal)
+	resp.Header.ResponseCode = RCODE_NAME_ERROR
+	for _, rr := range zone {
+		if isSubdomainOf(rr.Name, name) {
+			resp.Header.ResponseCode = RCODE_NO_ERROR
+		}
+	}
+	resp.Authority = recordsOf(zone, origin, TYPE_SOA)
+	return resp
+}
+
+// the most specific zone of the server that contains name
+func (s *fakeServer) zoneFor(name string) (string, bool) {
+	best, found := "", false
+	for origin := range s.zones {
+		if isSubdomainOf(name, origin) && (!found || len(origin) > len(best)) {
+			best, found = origin, true
+		}
+	}
+	return best, found
+}
+
+// the closest zone cut below origin that contains name
+func delegation(origin string, zone []RR, name string) (string, bool) {
+	best, found := "", false
+	for _, rr := range zone {
+		if rr.Type != TYPE_NS || nameEq(rr.Name, origin) || !isSubdomainOf(name, rr.Name) {
+			continue
+		}
+		if !found || len(rr.Name) > len(best) {
+			best, found = rr.Name, true
+		}
+	}
+	return best, found
+}
+
+func recordsOf(zone []RR, name string, types ...uint16) []RR {
+	rrs := make([]RR, 0)
+	for _, rr := range zone {
+		for _, ty := range types {
+			if rr.Type == ty && nameEq(rr.Name, name) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// a small hierarchy with a root server, a server for the com and net tlds and a few leaf zones
+func newFakeHierarchy(t testing.TB) *fakeNetwork {
+	n := newFakeNetwork()
+	n.addZone(t, ".", `
+@                   86400  SOA  a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+@                   518400 NS   a.root-servers.net.
+a.root-servers.net. 518400 A    198.41.0.4
+com.                172800 NS   a.gtld-servers.net.
+net.                172800 NS   a.gtld-servers.net.
+a.gtld-servers.net. 172800 A    192.5.6.30
+`, "198.41.0.4")
+	n.addZone(t, "com.", `
+@              900    SOA  a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+@              172800 NS   a.gtld-servers.net.
+example        172800 NS   ns1.example.com.
+example        172800 NS   ns2.example.com.
+ns1.example    172800 A    10.0.0.1
+ns2.example    172800 A    10.0.0.2
+glueless       172800 NS   ns.example.net.
+`, "192.5.6.30")
+	n.addZone(t, "net.", `
+@              900    SOA  a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+@              172800 NS   a.gtld-servers.net.
+example        172800 NS   ns1.example.com.
+`, "192.5.6.30")
+	n.addZone(t, "example.com.", `
+$TTL 300
+@         SOA   ns1 hostmaster 1 7200 3600 1209600 300
+@         NS    ns1
+@         NS    ns2
+@         MX    10 mail
+ns1       A     10.0.0.1
+ns2       A     10.0.0.2
+www       A     10.0.1.1
+          AAAA  2001:db8::1
+mail      A     10.0.1.2
+alias     CNAME www
+external  CNAME www.example.net.
+dangling  CNAME missing
+loop      CNAME loop.example.net.
+txt       TXT   "hello world"
+a.b.c     A     10.0.1.3
+`, "10.0.0.1", "10.0.0.2")
+	n.addZone(t, "example.net.", `
+$TTL 300
+@         SOA   ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300
+@         NS    ns1.example.com.
+ns        A     10.0.0.3
+www       A     10.0.2.1
+loop      CNAME loop.example.com.
+`, "10.0.0.1")
+	n.addZone(t, "glueless.com.", `
+$TTL 300
+@         SOA   ns.example.net. hostmaster 1 7200 3600 1209600 300
+@         NS    ns.example.net.
+www       A     10.0.3.1
+`, "10.0.0.3")
+	return n
+}
+
+func newTestResolver(t *testing.T, network *fakeNetwork, config ResolverConfig) *Resolver {
+	config.RootHints = &RootHints{
+		Nameservers: []string{"a.root-servers.net"},
+		Ipv4:        map[string][4]byte{"a.root-servers.net": {198, 41, 0, 4}},
+		Ipv6:        map[string][16]byte{},
+	}
+	config.Transport = network
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func resolveTest(t testing.TB, r *Resolver, name string, ty uint16) *Message {
+	resp, err := r.Resolve(context.Background(), name, ty, CLASS_IN)
+	if err != nil {
+		t.Fatalf("failed to resolve %v %v: %v", name, typeToString(ty), err)
+	}
+	return resp
+}
+
+func answerStrings(resp *Message) []string {
+	answers := make([]string, 0, len(resp.Answers))
+	for _, rr := range resp.Answers {
+		answers = append(answers, fmt.Sprintf("%v %v %v", rr.Name, typeToString(rr.Type), rr.Data))
+	}
+	return answers
+}
+
+func assertAnswers(t *testing.T, res *Message, expected ...string) {
+	t.Helper()
+	answers := answerStrings(res)
+	assert(t, strings.Join(answers, "\n"), strings.Join(expected, "\n"))
+}
+
+func TestResolveReferrals(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	res := resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assert(t, len(res.Answers), 1)
+	assert(t, res.Answers[0].Data.(*RR_A).Addr, [4]byte{10, 0, 1, 1})
+	assert(t, network.queriesTo("198.41.0.4"), 1)
+	assert(t, network.queriesTo("192.5.6.30"), 1)
+	assert(t, network.totalQueries(), 3)
+
+	// answered from the cache
+	res = resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, len(res.Answers), 1)
+	assert(t, network.totalQueries(), 3)
+
+	// the delegation is cached, only the example.com servers are asked
+	res = resolveTest(t, r, "mail.example.com", TYPE_A)
+	assert(t, res.Answers[0].Data.(*RR_A).Addr, [4]byte{10, 0, 1, 2})
+	assert(t, network.totalQueries(), 4)
+
+	res = resolveTest(t, r, "www.example.com", TYPE_AAAA)
+	assert(t, len(res.Answers), 1)
+	res = resolveTest(t, r, "example.com", TYPE_MX)
+	assertAnswers(t, res, "example.com MX 10 mail.example.com")
+	res = resolveTest(t, r, "txt.example.com", TYPE_TXT)
+	assertAnswers(t, res, "txt.example.com TXT hello world")
+}
+
+func TestResolveGlueNotAnswered(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	// the referral caches the example.com nameservers and their glue
+	resolveTest(t, r, "www.example.com", TYPE_A)
+	queries := network.totalQueries()
+
+	// glue and referral nameservers are not answered from the cache, the zone is asked instead
+	res := resolveTest(t, r, "ns1.example.com", TYPE_A)
+	assertAnswers(t, res, "ns1.example.com A 10.0.0.1")
+	assert(t, res.Answers[0].TTL, uint32(300))
+	res = resolveTest(t, r, "example.com", TYPE_NS)
+	assertAnswers(t, res, "example.com NS ns1.example.com", "example.com NS ns2.example.com")
+	assert(t, res.Answers[0].TTL, uint32(300))
+	assert(t, network.totalQueries(), queries+2)
+
+	// the authoritative answers replace the referral data and are then cached
+	resolveTest(t, r, "ns1.example.com", TYPE_A)
+	resolveTest(t, r, "example.com", TYPE_NS)
+	assert(t, network.totalQueries(), queries+2)
+}
+
+func TestResolveCNAME(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	res := resolveTest(t, r, "alias.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assertAnswers(t, res,
+		"alias.example.com CNAME www.example.com",
+		"www.example.com A 10.0.1.1")
+
+	// the target is in another zone
+	res = resolveTest(t, r, "external.example.com", TYPE_A)
+	assertAnswers(t, res,
+		"external.example.com CNAME www.example.net",
+		"www.example.net A 10.0.2.1")
+
+	// the chain is reassembled from the cache
+	queries := network.totalQueries()
+	res = resolveTest(t, r, "external.example.com", TYPE_A)
+	assert(t, len(res.Answers), 2)
+	assert(t, network.totalQueries(), queries)
+
+	// the target does not exist
+	res = resolveTest(t, r, "dangling.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+	assertAnswers(t, res, "dangling.example.com CNAME missing.example.com")
+
+	// a loop across zones terminates
+	res = resolveTest(t, r, "loop.example.com", TYPE_A)
+	assertAnswers(t, res,
+		"loop.example.com CNAME loop.example.net",
+		"loop.example.net CNAME loop.example.com")
+}
+
+func TestResolveCNAMETTL(t *testing.T) {
+	network := newFakeHierarchy(t)
+	cache := NewSharedResourceCache()
+	r := newTestResolver(t, network, ResolverConfig{ResourceCache: cache})
+
+	cname := RR{RR_Header: RR_Header{Name: "alias.example.org", Type: TYPE_CNAME, Class: CLASS_IN, TTL: 3600}, Data: &RR_CNAME{CNAME: "www.example.org"}}
+	target := RR{RR_Header: RR_Header{Name: "www.example.org", Type: TYPE_A, Class: CLASS_IN, TTL: 60}, Data: &RR_A{Addr: [4]byte{192, 0, 2, 1}}}
+	cache.Put("alias.example.org", TYPE_CNAME, []RR{cname}, CredibilityAuthoritativeAnswer)
+	cache.Put("www.example.org", TYPE_A, []RR{target}, CredibilityAuthoritativeAnswer)
+
+	// each record of the reassembled chain keeps its own decremented ttl
+	ageResourceCache(cache, 10*time.Second)
+	res := resolveTest(t, r, "alias.example.org", TYPE_A)
+	assertAnswers(t, res,
+		"alias.example.org CNAME www.example.org",
+		"www.example.org A 192.0.2.1")
+	assert(t, res.Answers[0].TTL, uint32(3590))
+	assert(t, res.Answers[1].TTL, uint32(50))
+	assert(t, network.totalQueries(), 0)
+
+	// the target expires before the cname, which is still answered from the cache
+	ageResourceCache(cache, 60*time.Second)
+	res = resolveTest(t, r, "alias.example.org", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+	assertAnswers(t, res, "alias.example.org CNAME www.example.org")
+	assert(t, res.Answers[0].TTL, uint32(3530))
+}
+
+func TestResolveTTLBounds(t *testing.T) {
+	network := newFakeHierarchy(t)
+	cache := NewSharedResourceCacheWithConfig(ResourceCacheConfig{
+		TTL:         TTLBounds{Min: time.Hour},
+		NegativeTTL: TTLBounds{Max: time.Minute},
+	})
+	r := newTestResolver(t, network, ResolverConfig{ResourceCache: cache})
+
+	// the first answer is clamped like the cached ones
+	for _, attempt := range []string{"first", "cached"} {
+		res := resolveTest(t, r, "alias.example.com", TYPE_A)
+		assertAnswers(t, res,
+			"alias.example.com CNAME www.example.com",
+			"www.example.com A 10.0.1.1")
+		assert(t, res.Answers[0].TTL, uint32(3600), attempt)
+		assert(t, res.Answers[1].TTL, uint32(3600), attempt)
+
+		res = resolveTest(t, r, "missing.example.com", TYPE_A)
+		assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+		assert(t, len(res.Authority), 1)
+		assert(t, res.Authority[0].TTL, uint32(60), attempt)
+	}
+}
+
+func TestResolveNegative(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	res := resolveTest(t, r, "missing.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+	assert(t, len(res.Answers), 0)
+	assert(t, len(res.Authority), 1)
+	assert(t, res.Authority[0].Type, TYPE_SOA)
+
+	// no data
+	res = resolveTest(t, r, "mail.example.com", TYPE_AAAA)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assert(t, len(res.Answers), 0)
+	assert(t, len(res.Authority), 1)
+
+	// empty non-terminal
+	res = resolveTest(t, r, "b.c.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assert(t, len(res.Answers), 0)
+
+	// negative answers are cached
+	queries := network.totalQueries()
+	res = resolveTest(t, r, "missing.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+	res = resolveTest(t, r, "mail.example.com", TYPE_AAAA)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assert(t, network.totalQueries(), queries)
+
+	// nxdomain from the root
+	res = resolveTest(t, r, "example.invalid", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+}
+
+func TestResolveGlueless(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	// the glueless.com nameserver is ns.example.net, whose zone is itself delegated without glue
+	res := resolveTest(t, r, "www.glueless.com", TYPE_A)
+	assertAnswers(t, res, "www.glueless.com A 10.0.3.1")
+	assert(t, network.queriesTo("10.0.0.3"), 1)
+}
+
+func TestResolveInBailiwickWithoutGlue(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	resolveTest(t, r, "www.example.com", TYPE_A)
+
+	// the delegation of example.com is still cached but the addresses of its nameservers are not,
+	// they can only be found again through the com servers
+	r.config.ResourceCache.Flush("ns1.example.com", TYPE_A)
+	r.config.ResourceCache.Flush("ns2.example.com", TYPE_A)
+	queries := network.queriesTo("192.5.6.30")
+
+	res := resolveTest(t, r, "mail.example.com", TYPE_A)
+	assertAnswers(t, res, "mail.example.com A 10.0.1.2")
+	assert(t, network.queriesTo("192.5.6.30"), queries+1)
+}
+
+func TestResolveIpv6Only(t *testing.T) {
+	network := newFakeNetwork()
+	network.addZone(t, ".", `
+@                   86400  SOA  a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+@                   518400 NS   a.root-servers.net.
+a.root-servers.net. 518400 AAAA 2001:db8::53
+example.            172800 NS   ns.example.net.
+example.            172800 NS   ns1.example.
+ns1.example.        172800 A    10.0.0.1
+`, "[2001:db8::53]")
+	network.addZone(t, "net.", `
+$TTL 300
+@               SOA   a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+ns.example      AAAA  2001:db8::2
+`, "[2001:db8::53]")
+	network.addZone(t, "example.", `
+$TTL 300
+@    SOA   ns1 hostmaster 1 7200 3600 1209600 300
+@    NS    ns.example.net.
+@    NS    ns1
+ns1  A     10.0.0.1
+www  A     10.0.1.1
+`, "10.0.0.1", "[2001:db8::2]")
+
+	r, err := NewResolver(ResolverConfig{
+		RootHints: &RootHints{
+			Nameservers: []string{"a.root-servers.net"},
+			Ipv4:        map[string][4]byte{},
+			Ipv6:        map[string][16]byte{"a.root-servers.net": [16]byte(net.ParseIP("2001:db8::53"))},
+		},
+		AddressFamily: AddressFamilyIpv6,
+		Transport:     network,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ns1.example only has ipv4 glue, the next nameserver is reachable over ipv6
+	res := resolveTest(t, r, "www.example", TYPE_A)
+	assertAnswers(t, res, "www.example A 10.0.1.1")
+	assert(t, network.queriesTo("10.0.0.1"), 0)
+	assert(t, network.queriesTo("[2001:db8::2]"), 1)
+}
+
+func TestRequestAny(t *testing.T) {
+	network := newFakeHierarchy(t)
+	network.server("10.0.0.1").delay = time.Second
+	addrs := []sockAddr{
+		{Ip: net.ParseIP("10.0.0.1"), Port: 53},
+		{Ip: net.ParseIP("10.0.0.2"), Port: 53},
+	}
+
+	// the second address is tried once the first one takes longer than the attempt delay
+	start := time.Now()
+	resp, err := requestAny(context.Background(), network, addrs, "www.example.com", TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, elapsed >= connectionAttemptDelay, true, elapsed.String())
+	assert(t, elapsed < time.Second, true, elapsed.String())
+	assert(t, network.queriesTo("10.0.0.1"), 1)
+	assert(t, network.queriesTo("10.0.0.2"), 1)
+
+	// a failed attempt starts the next one without waiting
+	network = newFakeHierarchy(t)
+	network.server("10.0.0.1").down = true
+	start = time.Now()
+	resp, err = requestAny(context.Background(), network, addrs, "www.example.com", TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed = time.Since(start)
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, elapsed < connectionAttemptDelay, true, elapsed.String())
+
+	// the error of the last attempt is returned if every attempt fails
+	network.server("10.0.0.2").down = true
+	_, err = requestAny(context.Background(), network, addrs, "www.example.com", TYPE_A)
+	assert(t, err != nil, true)
+}
+
+func TestResolveServerFailures(t *testing.T) {
+	network := newFakeHierarchy(t)
+	network.server("10.0.0.2").down = true
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	res := resolveTest(t, r, "www.example.com", TYPE_A)
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	assert(t, network.queriesTo("10.0.0.2"), 1)
+	assert(t, len(r.config.LameCache.Entries()), 0)
+
+	// a server that refuses to answer for the zone it was delegated is lame
+	network = newFakeHierarchy(t)
+	network.server("10.0.0.2").refused = true
+	r = newTestResolver(t, network, ResolverConfig{})
+
+	res = resolveTest(t, r, "www.example.com", TYPE_A)
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	lame := r.config.LameCache.Entries()
+	assert(t, len(lame), 1)
+	assert(t, lame[0].Zone, "example.com")
+	assert(t, lame[0].Nameserver, "ns2.example.com")
+	assert(t, lame[0].Reason, LameReasonRefused)
+
+	// the lame server is skipped
+	queries := network.queriesTo("10.0.0.2")
+	resolveTest(t, r, "mail.example.com", TYPE_A)
+	assert(t, network.queriesTo("10.0.0.2"), queries)
+
+	// a server failure may be transient, the server is only lame once it keeps failing
+	network = newFakeHierarchy(t)
+	network.server("10.0.0.2").servfail = true
+	r = newTestResolver(t, network, ResolverConfig{})
+	for i, name := range []string{"www.example.com", "mail.example.com"} {
+		res = resolveTest(t, r, name, TYPE_A)
+		assert(t, len(res.Answers), 1)
+		assert(t, network.queriesTo("10.0.0.2"), i+1)
+		assert(t, len(r.config.LameCache.Entries()), 0)
+	}
+	resolveTest(t, r, "txt.example.com", TYPE_TXT)
+	lame = r.config.LameCache.Entries()
+	assert(t, len(lame), 1)
+	assert(t, lame[0].Nameserver, "ns2.example.com")
+	assert(t, lame[0].Reason, LameReasonServerFailure)
+	queries = network.queriesTo("10.0.0.2")
+	resolveTest(t, r, "mail.example.com", TYPE_AAAA)
+	assert(t, network.queriesTo("10.0.0.2"), queries)
+
+	// no server responds at all
+	network = newFakeHierarchy(t)
+	network.server("198.41.0.4").down = true
+	r = newTestResolver(t, network, ResolverConfig{})
+	_, err := r.Resolve(context.Background(), "www.example.com", TYPE_A, CLASS_IN)
+	assert(t, errors.Is(err, ErrNoResponse), true, fmt.Sprint(err))
+}
+
+// make the cached records look like they were stored d earlier
+func ageResourceCache(cache *SharedResourceCache, d time.Duration) {
+	cache.Lock()
+	defer cache.Unlock()
+	for key, entry := range cache.entries {
+		entry.timestamp = entry.timestamp.Add(-d)
+		cache.entries[key] = entry
+	}
+}
+
+func TestResolveServeStale(t *testing.T) {
+	network := newFakeHierarchy(t)
+	cache := NewSharedResourceCacheWithConfig(ResourceCacheConfig{StaleWindow: time.Hour})
+	r := newTestResolver(t, network, ResolverConfig{ServeStale: true, ResourceCache: cache})
+
+	res := resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, res.Answers[0].TTL, uint32(300))
+
+	// the servers of the zone are down once the record expires
+	ageResourceCache(cache, 301*time.Second)
+	network.server("10.0.0.1").down = true
+	network.server("10.0.0.2").down = true
+	res = resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NO_ERROR)
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	assert(t, res.Answers[0].TTL, uint32(staleAnswerTTL))
+
+	// not served once it expired for longer than the stale window
+	ageResourceCache(cache, time.Hour)
+	_, err := r.Resolve(context.Background(), "www.example.com", TYPE_A, CLASS_IN)
+	assert(t, errors.Is(err, ErrZoneUnreachable), true, fmt.Sprint(err))
+
+	// without serve-stale the failure is returned
+	r = newTestResolver(t, network, ResolverConfig{})
+	_, err = r.Resolve(context.Background(), "mail.example.com", TYPE_A, CLASS_IN)
+	assert(t, errors.Is(err, ErrZoneUnreachable), true, fmt.Sprint(err))
+}
+
+func TestResolveServeStaleTimeout(t *testing.T) {
+	network := newFakeHierarchy(t)
+	cache := NewSharedResourceCacheWithConfig(ResourceCacheConfig{StaleWindow: time.Hour})
+	r := newTestResolver(t, network, ResolverConfig{ServeStale: true, StaleAnswerTimeout: 50 * time.Millisecond, ResourceCache: cache})
+
+	resolveTest(t, r, "www.example.com", TYPE_A)
+	ageResourceCache(cache, 301*time.Second)
+	network.server("10.0.0.1").delay = 500 * time.Millisecond
+	network.server("10.0.0.2").delay = 500 * time.Millisecond
+
+	// the client is answered with the stale record while the resolution continues
+	queries := network.totalQueries()
+	start := time.Now()
+	res := resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, time.Since(start) < 500*time.Millisecond, true, time.Since(start).String())
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	assert(t, res.Answers[0].TTL, uint32(staleAnswerTTL))
+
+	// later queries for the same question join the resolution in progress instead of starting their own
+	res = resolveTest(t, r, "www.example.com", TYPE_A)
+	assert(t, res.Answers[0].TTL, uint32(staleAnswerTTL))
+	assert(t, network.totalQueries(), queries+1)
+
+	// and refreshes the cache once it completes
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Get("www.example.com", TYPE_A) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale record was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, cache.Get("www.example.com", TYPE_A)[0].TTL, uint32(300))
+}
+
+func TestResolveRecursionLimits(t *testing.T) {
+	network := newFakeHierarchy(t)
+	limits := DefaultRecursionLimits()
+	limits.MaxUpstreamQueries = 2
+	r := newTestResolver(t, network, ResolverConfig{RecursionLimits: limits})
+
+	_, err := r.Resolve(context.Background(), "www.example.com", TYPE_A, CLASS_IN)
+	assert(t, errors.Is(err, ErrRecursionLimitExceeded), true, fmt.Sprint(err))
+	assert(t, network.totalQueries(), 2)
+
+	limits = DefaultRecursionLimits()
+	limits.MaxGluelessLookups = 1
+	r = newTestResolver(t, newFakeHierarchy(t), ResolverConfig{RecursionLimits: limits})
+	_, err = r.Resolve(context.Background(), "www.glueless.com", TYPE_A, CLASS_IN)
+	assert(t, errors.Is(err, ErrRecursionLimitExceeded), true, fmt.Sprint(err))
+}
+
+func TestPrimeRootServers(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	ttl, err := r.primeRootServers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ttl, uint32(518400))
+	nameservers := r.config.AuthorityCache.Get(rootZone)
+	assert(t, len(nameservers), 1)
+	assert(t, nameservers[0], "a.root-servers.net")
+}
+
+func TestResolverExchange(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{})
+
+	query := newQuery("www.example.com", TYPE_A)
+	query.Header.RecursionDesired = true
+	resp, err := r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.Id, query.Header.Id)
+	assert(t, resp.Header.Response, true)
+	assert(t, resp.Header.RecursionAvailable, true)
+	assert(t, resp.Header.RecursionDesired, true)
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+
+	resp, err = r.Resolve(context.Background(), "www.example.com", TYPE_A, CLASS_CH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_NOT_IMPLEMENTED)
+
+	query = newQuery("www.example.com", TYPE_A)
+	query.Header.Response = true
+	resp, err = r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_FORMAT_ERROR)
+}
@@ -1,16 +1,151 @@
 package dns
 
 import (
+	"fmt"
+	"log/slog"
 	"math"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
 var _ ResourceCache = (*SharedResourceCache)(nil)
 
+// ttl of expired records returned by GetStale, as recommended by RFC 8767
+const staleAnswerTTL = 30
+
+// how long a client waits for a resolution before being answered with stale records, as recommended by RFC 8767
+const defaultStaleAnswerTimeout = 1800 * time.Millisecond
+
+// fraction of the original ttl remaining below which popular entries are prefetched
+const prefetchThreshold = 0.1
+
+// Credibility ranks how trustworthy cached data is based on where it came from (RFC 2181 section 5.4.1).
+type Credibility uint8
+
+const (
+	// additional section, including glue
+	CredibilityAdditional Credibility = iota
+	// authority section of a non-authoritative response
+	CredibilityAuthority
+	// answer section of a non-authoritative response
+	CredibilityAnswer
+	// authority section of an authoritative response
+	CredibilityAuthoritativeAuthority
+	// answer section of an authoritative response
+	CredibilityAuthoritativeAnswer
+)
+
+func (c Credibility) String() string {
+	switch c {
+	case CredibilityAdditional:
+		return "additional"
+	case CredibilityAuthority:
+		return "authority"
+	case CredibilityAnswer:
+		return "answer"
+	case CredibilityAuthoritativeAuthority:
+		return "authoritative authority"
+	case CredibilityAuthoritativeAnswer:
+		return "authoritative answer"
+	default:
+		return "unknown"
+	}
+}
+
 type ResourceCache interface {
+	// returns the records of any credibility, including glue. only suitable for finding
+	// the addresses of nameservers.
 	Get(domain string, ty uint16) []RR
-	Put(domain string, ty uint16, rrs []RR)
+	// like Get but only returns records credible enough to answer clients with, at least
+	// CredibilityAnswer (RFC 2181 section 5.4.1)
+	GetAnswer(domain string, ty uint16) []RR
+	// like GetAnswer but also returns records that expired less than the stale window ago
+	GetStale(domain string, ty uint16) []RR
+	// store the records unless a fresh entry with higher credibility exists
+	Put(domain string, ty uint16, rrs []RR, credibility Credibility)
+	// returns the response code and SOA records of a cached negative answer (RFC 2308)
+	GetNegative(domain string, ty uint16) (uint8, []RR, bool)
+	PutNegative(domain string, ty uint16, rcode uint8, soa []RR)
+	// the entries that have not expired, sorted by domain and type
+	Entries() []CachedResource
+	// the entries of every type for the domain
+	Lookup(domain string) []CachedResource
+	Flush(domain string, ty uint16)
+	// flush the domain and every name below it
+	FlushSubtree(domain string)
+	FlushAll()
+}
+
+// CachedResource describes an entry of a ResourceCache.
+type CachedResource struct {
+	Domain string
+	Type   uint16
+	// negative entries hold the response code and SOA records of a negative answer
+	Negative     bool
+	ResponseCode uint8
+	Credibility  Credibility
+	// the records with their remaining ttl
+	Records []RR
+	Expires time.Time
+	Hits    int
+}
+
+// TTLBounds clamp the ttl of cached records. a zero bound is not applied.
+type TTLBounds struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (b TTLBounds) clamp(ttl uint32) uint32 {
+	if b.Min > 0 {
+		ttl = max(ttl, uint32(b.Min.Seconds()))
+	}
+	if b.Max > 0 {
+		ttl = min(ttl, uint32(b.Max.Seconds()))
+	}
+	return ttl
+}
+
+type ResourceCacheConfig struct {
+	// how long expired records are kept to be served by GetStale, disabled if zero
+	StaleWindow time.Duration
+	// called when an entry with at least PrefetchMinHits hits is in the last part of its
+	// ttl so that it can be refreshed before it expires. it must not block and returns false
+	// if the refresh was not started, the entry is then prefetched again on a later hit.
+	// prefetching is disabled if nil.
+	Prefetch        func(domain string, ty uint16) bool
+	PrefetchMinHits int
+
+	// bounds for positive entries
+	TTL TTLBounds
+	// bounds for negative entries
+	NegativeTTL TTLBounds
+	// bounds for positive entries of a given type, overriding TTL
+	TypeTTL map[uint16]TTLBounds
+	// bounds for positive entries at or below a zone, overriding TTL and TypeTTL.
+	// if zones are nested the most specific one is used.
+	ZoneTTL map[string]TTLBounds
+}
+
+// the ttl bounds that apply to positive entries for the given domain and type
+func (c *ResourceCacheConfig) positiveBounds(domain string, ty uint16) TTLBounds {
+	zoneLabels := -1
+	var zoneBounds TTLBounds
+	for zone, bounds := range c.ZoneTTL {
+		if labels := len(splitNameIntoLabels(zone)); labels > zoneLabels && isSubdomainOf(domain, zone) {
+			zoneLabels = labels
+			zoneBounds = bounds
+		}
+	}
+	if zoneLabels >= 0 {
+		return zoneBounds
+	}
+	if bounds, ok := c.TypeTTL[ty]; ok {
+		return bounds
+	}
+	return c.TTL
 }
 
 type resourceCacheKey struct {
@@ -19,67 +154,355 @@ type resourceCacheKey struct {
 }
 
 type resourceCacheEntry struct {
-	rrs       []RR
-	ttl       uint32
-	timestamp time.Time
+	negative    bool
+	rcode       uint8
+	credibility Credibility
+	rrs         []RR
+	ttl         uint32
+	timestamp   time.Time
+	hits        int
+	prefetching bool
 }
 
 type SharedResourceCache struct {
 	sync.Mutex
+	config  ResourceCacheConfig
 	entries map[resourceCacheKey]resourceCacheEntry
 }
 
 func NewSharedResourceCache() *SharedResourceCache {
+	return NewSharedResourceCacheWithConfig(ResourceCacheConfig{})
+}
+
+func NewSharedResourceCacheWithConfig(config ResourceCacheConfig) *SharedResourceCache {
 	return &SharedResourceCache{
 		Mutex:   sync.Mutex{},
+		config:  config,
 		entries: make(map[resourceCacheKey]resourceCacheEntry),
 	}
 }
 
 // Get implements ResourceCache.
 func (s *SharedResourceCache) Get(domain string, ty uint16) []RR {
+	return s.get(domain, ty, CredibilityAdditional, false)
+}
+
+// GetAnswer implements ResourceCache.
+func (s *SharedResourceCache) GetAnswer(domain string, ty uint16) []RR {
+	return s.get(domain, ty, CredibilityAnswer, false)
+}
+
+// GetStale implements ResourceCache.
+// expired records are returned with a ttl of staleAnswerTTL.
+func (s *SharedResourceCache) GetStale(domain string, ty uint16) []RR {
+	return s.get(domain, ty, CredibilityAnswer, true)
+}
+
+func (s *SharedResourceCache) get(domain string, ty uint16, minimum Credibility, allowStale bool) []RR {
+	rrs, prefetch := s.getLocked(domain, ty, minimum, allowStale)
+	if prefetch && !s.config.Prefetch(domain, ty) {
+		s.Lock()
+		key := resourceCacheKey{domain: domain, ty: ty}
+		if entry, ok := s.entries[key]; ok {
+			entry.prefetching = false
+			s.entries[key] = entry
+		}
+		s.Unlock()
+	}
+	return rrs
+}
+
+// returns the records and if the entry should be prefetched
+func (s *SharedResourceCache) getLocked(domain string, ty uint16, minimum Credibility, allowStale bool) ([]RR, bool) {
 	s.Lock()
 	defer s.Unlock()
 
 	key := resourceCacheKey{domain: domain, ty: ty}
 	entry, ok := s.entries[key]
-	if !ok {
-		return nil
+	if !ok || entry.negative || entry.credibility < minimum {
+		return nil, false
 	}
 
-	elapsed := uint32(time.Since(entry.timestamp).Seconds())
+	since := time.Since(entry.timestamp)
+	elapsed := uint32(since.Seconds())
 	if elapsed >= entry.ttl {
-		delete(s.entries, key)
-		return nil
+		expiredFor := since - time.Duration(entry.ttl)*time.Second
+		if expiredFor >= s.config.StaleWindow {
+			delete(s.entries, key)
+			return nil, false
+		}
+		if !allowStale {
+			return nil, false
+		}
+	}
+
+	prefetch := false
+	if elapsed < entry.ttl {
+		entry.hits += 1
+		remaining := entry.ttl - elapsed
+		if s.config.Prefetch != nil && !entry.prefetching && entry.hits >= s.config.PrefetchMinHits &&
+			float64(remaining) <= float64(entry.ttl)*prefetchThreshold {
+			entry.prefetching = true
+			prefetch = true
+		}
+		s.entries[key] = entry
 	}
 
 	rrs := make([]RR, len(entry.rrs))
 	for idx, rr := range entry.rrs {
 		rrs[idx] = rr
-		rrs[idx].TTL -= elapsed
+		if elapsed >= entry.ttl {
+			rrs[idx].TTL = staleAnswerTTL
+		} else {
+			rrs[idx].TTL -= elapsed
+		}
 	}
 
-	return rrs
+	return rrs, prefetch
 }
 
 // Put implements ResourceCache.
-func (s *SharedResourceCache) Put(domain string, ty uint16, rrs []RR) {
+// the ttl of the records is clamped to the configured bounds.
+func (s *SharedResourceCache) Put(domain string, ty uint16, rrs []RR, credibility Credibility) {
 	if len(rrs) == 0 {
 		return
 	}
 
-	key := resourceCacheKey{domain: domain, ty: ty}
+	bounds := s.config.positiveBounds(domain, ty)
+	clamped := make([]RR, len(rrs))
 	minTTL := uint32(math.MaxUint32)
-	for _, rr := range rrs {
-		minTTL = min(minTTL, rr.TTL)
+	for idx, rr := range rrs {
+		clamped[idx] = rr
+		clamped[idx].TTL = bounds.clamp(rr.TTL)
+		minTTL = min(minTTL, clamped[idx].TTL)
 	}
 
+	key := resourceCacheKey{domain: domain, ty: ty}
+
 	s.Lock()
 	defer s.Unlock()
 
+	now := time.Now()
+	if existing, ok := s.entries[key]; ok && existing.credibility > credibility && !existing.expired(now) {
+		return
+	}
+
 	s.entries[key] = resourceCacheEntry{
-		rrs:       rrs,
-		ttl:       minTTL,
-		timestamp: time.Now(),
+		credibility: credibility,
+		rrs:         clamped,
+		ttl:         minTTL,
+		timestamp:   now,
+	}
+}
+
+func (e *resourceCacheEntry) expired(now time.Time) bool {
+	return uint32(now.Sub(e.timestamp).Seconds()) >= e.ttl
+}
+
+// GetNegative implements ResourceCache.
+func (s *SharedResourceCache) GetNegative(domain string, ty uint16) (uint8, []RR, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := resourceCacheKey{domain: domain, ty: ty}
+	entry, ok := s.entries[key]
+	if !ok || !entry.negative {
+		return 0, nil, false
+	}
+
+	elapsed := uint32(time.Since(entry.timestamp).Seconds())
+	if elapsed >= entry.ttl {
+		delete(s.entries, key)
+		return 0, nil, false
+	}
+
+	soa := make([]RR, len(entry.rrs))
+	for idx, rr := range entry.rrs {
+		soa[idx] = rr
+		soa[idx].TTL -= elapsed
+	}
+
+	return entry.rcode, soa, true
+}
+
+// PutNegative implements ResourceCache.
+// negative answers come from authoritative responses and replace any existing entry.
+// the ttl of the entry is the minimum of the SOA ttl and its MINIMUM field (RFC 2308 section 5),
+// clamped to the configured negative bounds.
+func (s *SharedResourceCache) PutNegative(domain string, ty uint16, rcode uint8, soa []RR) {
+	if len(soa) == 0 {
+		return
+	}
+
+	ttl := uint32(math.MaxUint32)
+	for _, rr := range soa {
+		ttl = min(ttl, rr.TTL)
+		if rr_soa, ok := rr.Data.(*RR_SOA); ok {
+			ttl = min(ttl, rr_soa.MINIMUM)
+		}
+	}
+	ttl = s.config.NegativeTTL.clamp(ttl)
+
+	clamped := make([]RR, len(soa))
+	for idx, rr := range soa {
+		clamped[idx] = rr
+		clamped[idx].TTL = ttl
+	}
+
+	key := resourceCacheKey{domain: domain, ty: ty}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.entries[key] = resourceCacheEntry{
+		negative:    true,
+		rcode:       rcode,
+		credibility: CredibilityAuthoritativeAnswer,
+		rrs:         clamped,
+		ttl:         ttl,
+		timestamp:   time.Now(),
+	}
+}
+
+// Entries implements ResourceCache.
+func (s *SharedResourceCache) Entries() []CachedResource {
+	return s.collect(func(key resourceCacheKey) bool { return true })
+}
+
+// Lookup implements ResourceCache.
+func (s *SharedResourceCache) Lookup(domain string) []CachedResource {
+	return s.collect(func(key resourceCacheKey) bool { return nameEq(key.domain, domain) })
+}
+
+// Flush implements ResourceCache.
+func (s *SharedResourceCache) Flush(domain string, ty uint16) {
+	s.remove(func(key resourceCacheKey) bool { return key.ty == ty && nameEq(key.domain, domain) })
+}
+
+// FlushSubtree implements ResourceCache.
+func (s *SharedResourceCache) FlushSubtree(domain string) {
+	domain = trimWildcard(domain)
+	s.remove(func(key resourceCacheKey) bool { return isSubdomainOf(key.domain, domain) })
+}
+
+// FlushAll implements ResourceCache.
+func (s *SharedResourceCache) FlushAll() {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = make(map[resourceCacheKey]resourceCacheEntry)
+}
+
+func (s *SharedResourceCache) collect(filter func(resourceCacheKey) bool) []CachedResource {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	entries := make([]CachedResource, 0)
+	for key, entry := range s.entries {
+		if !filter(key) {
+			continue
+		}
+		elapsed := uint32(now.Sub(entry.timestamp).Seconds())
+		if elapsed >= entry.ttl {
+			continue
+		}
+		records := make([]RR, len(entry.rrs))
+		for idx, rr := range entry.rrs {
+			records[idx] = rr
+			records[idx].TTL -= elapsed
+		}
+		entries = append(entries, CachedResource{
+			Domain:       key.domain,
+			Type:         key.ty,
+			Negative:     entry.negative,
+			ResponseCode: entry.rcode,
+			Credibility:  entry.credibility,
+			Records:      records,
+			Expires:      entry.timestamp.Add(time.Duration(entry.ttl) * time.Second),
+			Hits:         entry.hits,
+		})
+	}
+	slices.SortFunc(entries, func(a, b CachedResource) int {
+		if c := strings.Compare(a.Domain, b.Domain); c != 0 {
+			return c
+		}
+		return int(a.Type) - int(b.Type)
+	})
+	return entries
+}
+
+func (s *SharedResourceCache) remove(filter func(resourceCacheKey) bool) {
+	s.Lock()
+	defer s.Unlock()
+	for key := range s.entries {
+		if filter(key) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *SharedResourceCache) snapshot() []resourceSnapshotEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	entries := make([]resourceSnapshotEntry, 0, len(s.entries))
+	for key, entry := range s.entries {
+		records := make([][]byte, 0, len(entry.rrs))
+		for _, rr := range entry.rrs {
+			encoded, err := encodeSnapshotRecord(rr)
+			if err != nil {
+				slog.Debug("failed to encode cached record for snapshot", "domain", key.domain, "error", err)
+				break
+			}
+			records = append(records, encoded)
+		}
+		if len(records) != len(entry.rrs) {
+			continue
+		}
+		entries = append(entries, resourceSnapshotEntry{
+			Domain:      key.domain,
+			Type:        key.ty,
+			Negative:    entry.negative,
+			Rcode:       entry.rcode,
+			Credibility: entry.credibility,
+			Timestamp:   entry.timestamp,
+			Expires:     entry.timestamp.Add(time.Duration(entry.ttl) * time.Second),
+			Records:     records,
+		})
+	}
+	return entries
+}
+
+// insert the snapshot entries, all records are decoded before the cache is modified.
+func (s *SharedResourceCache) restore(snapshot []resourceSnapshotEntry) error {
+	entries := make(map[resourceCacheKey]resourceCacheEntry, len(snapshot))
+	for _, entry := range snapshot {
+		rrs := make([]RR, len(entry.Records))
+		for idx, record := range entry.Records {
+			rr, err := decodeSnapshotRecord(record)
+			if err != nil {
+				return err
+			}
+			rrs[idx] = rr
+		}
+		if len(rrs) == 0 || !entry.Expires.After(entry.Timestamp) {
+			return fmt.Errorf("%w: invalid entry for %v", ErrInvalidCacheSnapshot, entry.Domain)
+		}
+		key := resourceCacheKey{domain: entry.Domain, ty: entry.Type}
+		entries[key] = resourceCacheEntry{
+			negative:    entry.Negative,
+			rcode:       entry.Rcode,
+			credibility: entry.Credibility,
+			rrs:         rrs,
+			ttl:         uint32(entry.Expires.Sub(entry.Timestamp).Seconds()),
+			timestamp:   entry.Timestamp,
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for key, entry := range entries {
+		s.entries[key] = entry
 	}
+	return nil
 }
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package dns
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// zone name of the root, as returned by the decoder
+const rootZone = ""
+
+const defaultRootPrimingInterval = 24 * time.Hour
+const rootPrimingRetryDelay = time.Minute
+
+// RootHints are the names and addresses of the root name servers used to bootstrap recursion.
+// names are stored in lowercase and without the trailing dot.
+type RootHints struct {
+	Nameservers []string
+	Ipv4        map[string][4]byte
+	Ipv6        map[string][16]byte
+}
+
+// the built-in root hints
+func DefaultRootHints() *RootHints {
+	hints := &RootHints{
+		Nameservers: make([]string, 0, len(RootNameServers)),
+		Ipv4:        make(map[string][4]byte),
+		Ipv6:        make(map[string][16]byte),
+	}
+	for _, nameserver := range RootNameServers {
+		hints.Nameservers = append(hints.Nameservers, normalizeHintName(nameserver))
+	}
+	for nameserver, ip := range RootNameServersIpv4 {
+		hints.Ipv4[normalizeHintName(nameserver)] = ip
+	}
+	for nameserver, ip := range RootNameServersIpv6 {
+		hints.Ipv6[normalizeHintName(nameserver)] = ip
+	}
+	return hints
+}
+
+// load root hints from a file in the format of the named.root file distributed by IANA
+func LoadRootHints(path string) (*RootHints, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRootHints(f)
+}
+
+func ParseRootHints(r io.Reader) (*RootHints, error) {
+	rrs, err := parseZone(r, rootZone)
+	if err != nil {
+		return nil, err
+	}
+
+	hints := &RootHints{
+		Nameservers: make([]string, 0),
+		Ipv4:        make(map[string][4]byte),
+		Ipv6:        make(map[string][16]byte),
+	}
+	for _, rr := range rrs {
+		switch data := rr.Data.(type) {
+		case *RR_NS:
+			if rr.Name == rootZone {
+				hints.Nameservers = append(hints.Nameservers, data.Nameserver)
+			}
+		case *RR_A:
+			hints.Ipv4[rr.Name] = data.Addr
+		case *RR_AAAA:
+			hints.Ipv6[rr.Name] = data.Addr
+		}
+	}
+
+	if len(hints.Nameservers) == 0 {
+		return nil, fmt.Errorf("root hints do not contain any root nameservers")
+	}
+
+	for _, nameserver := range hints.Nameservers {
+		_, hasIpv4 := hints.Ipv4[nameserver]
+		_, hasIpv6 := hints.Ipv6[nameserver]
+		if !hasIpv4 && !hasIpv6 {
+			return nil, fmt.Errorf("root hints do not contain an address for %v", nameserver)
+		}
+	}
+
+	return hints, nil
+}
+
+// the hinted addresses of a root server, or nil if the name is not a root server.
+func (h *RootHints) addressRRs(name string, ty uint16) []RR {
+	name = normalizeHintName(name)
+	header := RR_Header{
+		Name:  name,
+		Type:  ty,
+		Class: CLASS_IN,
+	}
+	switch ty {
+	case TYPE_A:
+		if ip, ok := h.Ipv4[name]; ok {
+			return []RR{{RR_Header: header, Data: &RR_A{Addr: ip}}}
+		}
+	case TYPE_AAAA:
+		if ip, ok := h.Ipv6[name]; ok {
+			return []RR{{RR_Header: header, Data: &RR_AAAA{Addr: ip}}}
+		}
+	}
+	return nil
+}
+
+func normalizeHintName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// send a priming query (RFC 8109) to the root servers and store the current root
+// nameservers and their addresses in the caches.
+// returns the ttl of the root nameserver set.
+func (r *Resolver) primeRootServers(ctx context.Context) (uint32, error) {
+	sockaddrs := make([]sockAddr, 0)
+	for _, nameserver := range r.config.RootHints.Nameservers {
+		for _, ty := range r.config.AddressFamily.recordTypes() {
+			for _, ip := range extractIpsFromRRs(r.config.RootHints.addressRRs(nameserver, ty)) {
+				sockaddrs = append(sockaddrs, sockAddr{Ip: ip, Port: 53})
+			}
+		}
+	}
+
+	resp, err := requestAny(ctx, r.config.Transport, sockaddrs, rootZone, TYPE_NS)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.Header.ResponseCode != RCODE_NO_ERROR {
+		return 0, fmt.Errorf("priming query failed with response code %v", resp.Header.ResponseCode)
+	}
+
+	ttl := uint32(math.MaxUint32)
+	nameservers := make([]string, 0)
+	for _, rr := range resp.Answers {
+		if rr_ns, ok := rr.Data.(*RR_NS); ok && rr.Name == rootZone {
+			nameservers = append(nameservers, rr_ns.Nameserver)
+			ttl = min(ttl, rr.TTL)
+		}
+	}
+
+	if len(nameservers) == 0 {
+		return 0, fmt.Errorf("priming response did not contain root nameservers")
+	}
+
+	r.config.AuthorityCache.Put(rootZone, nameservers, ttl)
+	cacheResponse(r.config.ResourceCache, rootZone, resp)
+
+	slog.Debug("primed root nameservers", "nameservers", len(nameservers), "ttl", ttl)
+	return ttl, nil
+}
+
+// prime the root nameservers at startup and refresh them periodically until ctx is cancelled.
+// does nothing if queries are forwarded.
+func (r *Resolver) runRootPriming(ctx context.Context) {
+	if len(r.config.Forwarders) != 0 {
+		return
+	}
+	for {
+		delay := r.config.RootPrimingInterval
+		if ttl, err := r.primeRootServers(ctx); err != nil {
+			slog.Warn("failed to prime root nameservers", "error", err)
+			delay = rootPrimingRetryDelay
+		} else {
+			delay = max(min(delay, time.Duration(ttl)*time.Second), rootPrimingRetryDelay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig configures response rate limiting of udp responses, which limits how much
+// the server can be used to reflect traffic to spoofed addresses. clients are grouped by
+// network prefix and every response category of a group has its own token bucket.
+type RateLimitConfig struct {
+	// responses with records or without records of the requested type, per second. zero disables the limit.
+	ResponsesPerSecond int
+	// NXDOMAIN responses per second. zero disables the limit.
+	NxdomainsPerSecond int
+	// error responses per second. zero disables the limit.
+	ErrorsPerSecond int
+	// how many seconds of unused responses a bucket can accumulate for bursts
+	Window time.Duration
+	// length of the prefixes clients are grouped by
+	Ipv4PrefixLength int
+	Ipv6PrefixLength int
+	// every Slip-th limited response is answered with an empty truncated response, so legitimate
+	// clients retry over tcp, the others are dropped. zero drops every limited response.
+	Slip int
+	// log the responses that would be limited without limiting them
+	LogOnly bool
+	// maximum number of buckets kept, buckets that are full again are evicted first and then
+	// the least recently used ones
+	MaxEntries int
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		ResponsesPerSecond: 20,
+		NxdomainsPerSecond: 5,
+		ErrorsPerSecond:    5,
+		Window:             15 * time.Second,
+		Ipv4PrefixLength:   24,
+		Ipv6PrefixLength:   56,
+		Slip:               2,
+		MaxEntries:         100000,
+	}
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.ResponsesPerSecond < 0 || c.NxdomainsPerSecond < 0 || c.ErrorsPerSecond < 0 || c.Window <= 0 ||
+		c.Ipv4PrefixLength < 0 || c.Ipv4PrefixLength > 32 || c.Ipv6PrefixLength < 0 || c.Ipv6PrefixLength > 128 ||
+		c.Slip < 0 || c.MaxEntries <= 0 {
+		return fmt.Errorf("invalid rate limit configuration: %+v", *c)
+	}
+	return nil
+}
+
+type responseCategory uint8
+
+const (
+	responseCategoryAnswer responseCategory = iota
+	responseCategoryNxdomain
+	responseCategoryError
+)
+
+func (c responseCategory) String() string {
+	switch c {
+	case responseCategoryAnswer:
+		return "answer"
+	case responseCategoryNxdomain:
+		return "nxdomain"
+	default:
+		return "error"
+	}
+}
+
+func categorizeResponse(m *Message) responseCategory {
+	switch m.Header.ResponseCode {
+	case RCODE_NO_ERROR:
+		return responseCategoryAnswer
+	case RCODE_NAME_ERROR:
+		return responseCategoryNxdomain
+	default:
+		return responseCategoryError
+	}
+}
+
+type rateLimitVerdict uint8
+
+const (
+	rateLimitSend rateLimitVerdict = iota
+	rateLimitSlip
+	rateLimitDrop
+)
+
+// when the table is full and no bucket is full again, 1/rateLimitEvictDivisor of the buckets are evicted
+const rateLimitEvictDivisor = 10
+
+type rateLimitKey struct {
+	prefix   netip.Prefix
+	category responseCategory
+}
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	// responses limited since the bucket ran out of tokens
+	limited int
+}
+
+type responseRateLimiter struct {
+	config RateLimitConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[rateLimitKey]*rateLimitBucket
+}
+
+func newResponseRateLimiter(config RateLimitConfig) *responseRateLimiter {
+	return &responseRateLimiter{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[rateLimitKey]*rateLimitBucket),
+	}
+}
+
+func (l *responseRateLimiter) rate(category responseCategory) int {
+	switch category {
+	case responseCategoryAnswer:
+		return l.config.ResponsesPerSecond
+	case responseCategoryNxdomain:
+		return l.config.NxdomainsPerSecond
+	default:
+		return l.config.ErrorsPerSecond
+	}
+}
+
+// decide if the response to client is sent, replaced by a truncated response or dropped
+func (l *responseRateLimiter) check(client netip.Addr, response *Message) rateLimitVerdict {
+	category := categorizeResponse(response)
+	rate := l.rate(category)
+	if rate == 0 {
+		return rateLimitSend
+	}
+
+	client = client.Unmap()
+	bits := l.config.Ipv6PrefixLength
+	if client.Is4() {
+		bits = l.config.Ipv4PrefixLength
+	}
+	prefix, err := client.Prefix(bits)
+	if err != nil {
+		return rateLimitSend
+	}
+	key := rateLimitKey{prefix: prefix, category: category}
+	capacity := float64(rate) * l.config.Window.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.config.MaxEntries {
+			l.evict(now)
+		}
+		bucket = &rateLimitBucket{tokens: capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*float64(rate))
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		if bucket.limited != 0 {
+			slog.Info("response rate limit lifted", "prefix", prefix, "category", category, "limited", bucket.limited)
+			bucket.limited = 0
+		}
+		return rateLimitSend
+	}
+
+	bucket.limited += 1
+	if bucket.limited == 1 {
+		slog.Info("response rate limit exceeded", "prefix", prefix, "category", category, "log_only", l.config.LogOnly)
+	}
+	if l.config.LogOnly {
+		return rateLimitSend
+	}
+	if l.config.Slip != 0 && bucket.limited%l.config.Slip == 0 {
+		return rateLimitSlip
+	}
+	return rateLimitDrop
+}
+
+// make room for a new bucket. the buckets that would be full by now are removed first since
+// they limit nothing, then the least recently used ones, so that a flood of new prefixes does
+// not reset the buckets of the clients that are being limited.
+func (l *responseRateLimiter) evict(now time.Time) {
+	for key, bucket := range l.buckets {
+		rate := float64(l.rate(key.category))
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*rate >= rate*l.config.Window.Seconds() {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) < l.config.MaxEntries {
+		return
+	}
+
+	// evict a fraction of the table at once so that the sort is not repeated for every new bucket
+	keys := make([]rateLimitKey, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b rateLimitKey) int {
+		return l.buckets[a].updated.Compare(l.buckets[b].updated)
+	})
+	evicted := max(1, len(keys)/rateLimitEvictDivisor)
+	slog.Debug("response rate limit table is full, evicting the least recently used buckets", "entries", len(keys), "evicted", evicted)
+	for _, key := range keys[:evicted] {
+		delete(l.buckets, key)
+	}
+}
+
+// an empty response with the truncated flag set, telling the client to retry over tcp
+func truncatedResponse(m *Message) *Message {
+	truncated := &Message{Header: m.Header, Questions: m.Questions}
+	truncated.Header.Truncated = true
+	truncated.Header.QuestionCount = uint16(len(m.Questions))
+	truncated.Header.AnswerCount = 0
+	truncated.Header.AuthoritativeCount = 0
+	truncated.Header.AdditionalCount = 0
+	return truncated
+}
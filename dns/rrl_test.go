@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResponseRateLimiter(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.ResponsesPerSecond = 2
+	config.ErrorsPerSecond = 0
+	config.Window = time.Second
+	config.Slip = 2
+	limiter := newResponseRateLimiter(config)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	answer := &Message{}
+	nxdomain := &Message{}
+	nxdomain.Header.ResponseCode = RCODE_NAME_ERROR
+	failure := &Message{}
+	failure.Header.ResponseCode = RCODE_SERVER_FAILURE
+
+	client := netip.MustParseAddr("192.0.2.1")
+	neighbour := netip.MustParseAddr("192.0.2.200")
+	other := netip.MustParseAddr("198.51.100.1")
+
+	// the burst is shared by the /24, every second limited response slips
+	assert(t, limiter.check(client, answer), rateLimitSend)
+	assert(t, limiter.check(neighbour, answer), rateLimitSend)
+	assert(t, limiter.check(client, answer), rateLimitDrop)
+	assert(t, limiter.check(neighbour, answer), rateLimitSlip)
+	assert(t, limiter.check(client, answer), rateLimitDrop)
+
+	// other networks and categories have their own buckets, zero rates are not limited
+	assert(t, limiter.check(other, answer), rateLimitSend)
+	assert(t, limiter.check(client, nxdomain), rateLimitSend)
+	for i := 0; i < 100; i++ {
+		assert(t, limiter.check(client, failure), rateLimitSend)
+	}
+
+	// the bucket refills over time
+	now = now.Add(500 * time.Millisecond)
+	assert(t, limiter.check(client, answer), rateLimitSend)
+	assert(t, limiter.check(client, answer), rateLimitDrop)
+
+	// ipv6 clients are grouped by /56
+	v6 := netip.MustParseAddr("2001:db8:0:1::1")
+	assert(t, limiter.check(v6, answer), rateLimitSend)
+	assert(t, limiter.check(netip.MustParseAddr("2001:db8:0:ff::1"), answer), rateLimitSend)
+	assert(t, limiter.check(v6, answer), rateLimitDrop)
+
+	// log only mode never limits
+	config.LogOnly = true
+	limiter = newResponseRateLimiter(config)
+	for i := 0; i < 10; i++ {
+		assert(t, limiter.check(client, answer), rateLimitSend)
+	}
+
+	// a flood of new prefixes does not reset the bucket of a limited client
+	config = DefaultRateLimitConfig()
+	config.ResponsesPerSecond = 2
+	config.Window = time.Second
+	config.Slip = 0
+	config.MaxEntries = 10
+	limiter = newResponseRateLimiter(config)
+	limiter.now = func() time.Time { return now }
+	victim := netip.MustParseAddr("203.0.113.1")
+	assert(t, limiter.check(victim, answer), rateLimitSend)
+	assert(t, limiter.check(victim, answer), rateLimitSend)
+	for i := 0; i < 200; i++ {
+		now = now.Add(time.Millisecond)
+		spoofed := netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1})
+		assert(t, limiter.check(spoofed, answer), rateLimitSend)
+		assert(t, limiter.check(victim, answer), rateLimitDrop)
+		assert(t, len(limiter.buckets) <= config.MaxEntries, true)
+	}
+
+	// buckets that are full again are evicted before the others
+	now = now.Add(time.Second)
+	assert(t, limiter.check(victim, answer), rateLimitSend)
+	assert(t, limiter.check(netip.MustParseAddr("198.51.100.1"), answer), rateLimitSend)
+	assert(t, len(limiter.buckets), 2)
+
+	truncated := truncatedResponse(&Message{Questions: []Question{{Name: "example.com", Type: TYPE_A, Class: CLASS_IN}}, Answers: []RR{{}}})
+	assert(t, truncated.Header.Truncated, true)
+	assert(t, truncated.Header.QuestionCount, uint16(1))
+	assert(t, len(truncated.Answers), 0)
+}
@@ -2,32 +2,65 @@ package dns
 
 import (
 	"context"
-	"encoding/binary"
-	"hash/fnv"
+	"errors"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
 type ServerOption func(*ServerConfig) error
 
 type ServerConfig struct {
-	workers      int
-	tcpAddresses []string
-	udpAddresses []string
+	workers               int
+	queueSize             int
+	overloadAction        OverloadAction
+	tcpListeners          []listenerConfig
+	udpListeners          []listenerConfig
+	tlsListeners          []listenerConfig
+	httpsListeners        []listenerConfig
+	acl                   Acl
+	rateLimit             *RateLimitConfig
+	clientLimits          *ClientLimits
+	tcpLimits             TcpLimits
+	resolver              ResolverConfig
+	resourceCache         ResourceCacheConfig
+	prefetch              bool
+	cacheSnapshotPath     string
+	cacheSnapshotInterval time.Duration
 }
 
 type Server struct {
-	ctx       context.Context
-	cancel    context.CancelFunc
-	config    *ServerConfig
-	listeners []io.Closer
-	workers   []*worker
-}
-
-type messageWithAddr struct {
-	message *Message
-	addr    net.Addr
+	ctx            context.Context
+	cancel         context.CancelFunc
+	config         *ServerConfig
+	resolver       *Resolver
+	authorityCache *SharedAuthorityCache
+	resourceCache  *SharedResourceCache
+	lameCache      *SharedLameCache
+	scheduler      *scheduler
+	// nil if response rate limiting is disabled
+	rateLimiter *responseRateLimiter
+	// nil if client limits are disabled
+	clientLimiter *clientLimiter
+
+	// protects listeners, packetConns, httpServers and workers
+	mu          sync.Mutex
+	listeners   []io.Closer
+	packetConns []io.Closer
+	httpServers []*http.Server
+	workers     []*worker
+
+	// cancelled when the server starts shutting down, listeners stop accepting queries
+	draining      context.Context
+	stopAccepting context.CancelFunc
+	shutdownOnce  sync.Once
+	// open tcp connections, new connections are not tracked once draining is cancelled
+	connectionsMu sync.Mutex
+	connections   sync.WaitGroup
 }
 
 func NewServer(opts ...ServerOption) (*Server, error) {
@@ -38,192 +71,359 @@ func NewServer(opts ...ServerOption) (*Server, error) {
 			return nil, err
 		}
 	}
-
 	ctx, cancel := context.WithCancel(context.Background())
+	draining, stopAccepting := context.WithCancel(ctx)
 	server := &Server{
-		ctx:    ctx,
-		cancel: cancel,
-		config: config,
+		ctx:            ctx,
+		cancel:         cancel,
+		config:         config,
+		draining:       draining,
+		stopAccepting:  stopAccepting,
+		authorityCache: NewSharedAuthorityCache(),
+		lameCache:      NewSharedLameCache(),
+		scheduler:      newScheduler(config.queueSize, config.overloadAction),
+	}
+
+	resourceCacheConfig := config.resourceCache
+	if config.prefetch {
+		resourceCacheConfig.Prefetch = server.prefetch
+	}
+	server.resourceCache = NewSharedResourceCacheWithConfig(resourceCacheConfig)
+
+	if config.rateLimit != nil {
+		server.rateLimiter = newResponseRateLimiter(*config.rateLimit)
+	}
+	if config.clientLimits != nil {
+		server.clientLimiter = newClientLimiter(*config.clientLimits)
 	}
 
+	resolverConfig := config.resolver
+	resolverConfig.AuthorityCache = server.authorityCache
+	resolverConfig.ResourceCache = server.resourceCache
+	resolverConfig.LameCache = server.lameCache
+	resolver, err := NewResolver(resolverConfig)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	server.resolver = resolver
+
 	return server, nil
 }
 
+// start the workers and listeners and block until the server is shut down
 func (s *Server) Run() error {
 	defer s.Finish()
 
-	if len(s.config.tcpAddresses) == 0 && len(s.config.udpAddresses) == 0 {
+	if err := s.start(); err != nil {
+		return err
+	}
+
+	<-s.ctx.Done()
+
+	return nil
+}
+
+func (s *Server) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining.Err() != nil {
+		return nil
+	}
+
+	if len(s.config.tcpListeners) == 0 && len(s.config.udpListeners) == 0 && len(s.config.tlsListeners) == 0 && len(s.config.httpsListeners) == 0 {
 		slog.Warn("no listen addresses configured")
 	}
 
-	slog.Debug("spawning workers", "workers", s.config.workers)
-	authorityCache := NewSharedAuthorityCache()
-	resourceCache := NewSharedResourceCache()
-	for i := 0; i < s.config.workers; i++ {
-		worker := newWorker(authorityCache, resourceCache)
-		s.workers = append(s.workers, worker)
-		go worker.run()
+	if s.config.cacheSnapshotPath != "" {
+		s.loadCacheSnapshot()
+		go s.runCacheSnapshots()
 	}
 
-	for _, tcpAddr := range s.config.tcpAddresses {
-		slog.Debug("starting tcp listener", "address", tcpAddr)
-		listener, err := net.Listen("tcp", tcpAddr)
+	s.startWorkers()
+	go s.resolver.runRootPriming(s.ctx)
+
+	for _, tcpListener := range s.config.tcpListeners {
+		slog.Debug("starting tcp listener", "address", tcpListener.addr)
+		listener, err := net.Listen("tcp", tcpListener.addr)
 		if err != nil {
 			return err
 		}
 		s.listeners = append(s.listeners, listener)
-		go s.receiverTcp(listener)
+		go s.receiverTcp(listener, s.aclOf(tcpListener))
 	}
 
-	for _, udpAddr := range s.config.udpAddresses {
-		slog.Debug("starting udp listener", "address", udpAddr)
-		listener, err := net.ListenPacket("udp", udpAddr)
+	for _, tlsListener := range s.config.tlsListeners {
+		slog.Debug("starting tls listener", "address", tlsListener.addr)
+		listener, err := s.listenTls(tlsListener)
 		if err != nil {
 			return err
 		}
 		s.listeners = append(s.listeners, listener)
-		go s.udpReader(listener)
+		go s.receiverTcp(listener, s.aclOf(tlsListener))
 	}
 
-	<-s.ctx.Done()
+	for _, httpsListener := range s.config.httpsListeners {
+		slog.Debug("starting https listener", "address", httpsListener.addr)
+		listener, server, err := s.listenHttps(httpsListener)
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, listener)
+		s.httpServers = append(s.httpServers, server)
+		go func() {
+			err := server.ServeTLS(listener, "", "")
+			if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("https listener failed", "address", httpsListener.addr, "error", err)
+			}
+		}()
+	}
+
+	for _, udpListener := range s.config.udpListeners {
+		slog.Debug("starting udp listener", "address", udpListener.addr)
+		conns, err := listenUdp(udpListener)
+		if err != nil {
+			return err
+		}
+		for _, conn := range conns {
+			s.packetConns = append(s.packetConns, conn)
+			go s.udpReader(conn, s.aclOf(udpListener))
+		}
+	}
 
 	return nil
 }
 
+func (s *Server) startWorkers() {
+	slog.Debug("spawning workers", "workers", s.config.workers, "queue", s.config.queueSize, "family", s.config.resolver.AddressFamily)
+	for i := 0; i < s.config.workers; i++ {
+		worker := newWorker(s.scheduler, s.resolver)
+		s.workers = append(s.workers, worker)
+		go worker.run()
+	}
+}
+
+// stop the server immediately, queued and in-flight queries are dropped and the open
+// connections are closed
 func (s *Server) Finish() {
+	s.shutdownOnce.Do(func() {
+		s.shutdown(context.Background(), true)
+	})
+}
+
+// stop accepting queries and wait for the queued and in-flight queries to be answered.
+// once ctx is done the remaining queries are cancelled and ctx's error is returned.
+// the caches are saved if a snapshot path is configured, and Run returns once the shutdown completes.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		err = s.shutdown(ctx, false)
+	})
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context, immediate bool) error {
 	defer s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slog.Info("shutting down")
+	s.connectionsMu.Lock()
+	s.stopAccepting()
+	s.connectionsMu.Unlock()
 	for _, listener := range s.listeners {
 		listener.Close()
 	}
-	for _, worker := range s.workers {
-		worker.cancel()
-	}
-	s.listeners = nil
-	s.workers = nil
-}
 
-func (s *Server) submitJob(job workerJob) {
-	if len(job.message.Questions) == 0 {
-		s.workers[0].submit(job)
+	var err error
+	if immediate {
+		// closes the open connections and makes the workers exit without answering the queued queries
+		s.cancel()
+		for _, worker := range s.workers {
+			worker.cancel()
+		}
+		for _, worker := range s.workers {
+			<-worker.done
+		}
 	} else {
-		hasher := fnv.New64()
-		hasher.Write([]byte(job.message.Questions[0].Name))
-		sum := hasher.Sum64()
-		worker := s.workers[sum%uint64(len(s.workers))]
-		worker.submit(job)
+		err = s.drainWorkers(ctx)
 	}
-}
 
-func (s *Server) receiverTcp(listener net.Listener) {
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			slog.Warn("failed to accept tcp connection", "error", err)
-			continue
-		}
-		go s.tcpReader(conn)
+	// let tcp and https clients receive the last responses
+	connectionsDone := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(connectionsDone)
+	}()
+	select {
+	case <-connectionsDone:
+	case <-ctx.Done():
 	}
-}
 
-func (s *Server) tcpReader(conn net.Conn) {
-	ctx, cancel := context.WithCancel(s.ctx)
-
-	defer conn.Close()
-	defer cancel()
-
-	writeChann := make(chan *Message)
-	go s.tcpWriter(ctx, conn, writeChann)
+	for _, server := range s.httpServers {
+		server.Close()
+	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	s.resolver.Close()
+	if s.config.cacheSnapshotPath != "" {
+		s.saveCacheSnapshot()
+	}
+	slog.Info("shutdown complete")
+	return err
+}
 
-	for {
-		messageLengthBuf := make([]byte, 2)
-		if _, err := conn.Read(messageLengthBuf); err != nil {
-			if err != io.EOF {
-				slog.Error("failed to read message length from tcp connection", "error", err, "remote", conn.RemoteAddr())
-			}
-			break
+// wait for the workers to answer the queued and in-flight queries, cancelling them once ctx is done
+func (s *Server) drainWorkers(ctx context.Context) error {
+	workersDone := make(chan struct{})
+	go func() {
+		for _, worker := range s.workers {
+			worker.drain()
 		}
-
-		messageLength := binary.BigEndian.Uint16(messageLengthBuf)
-		messageBuf := make([]byte, messageLength)
-		if _, err := conn.Read(messageBuf); err != nil {
-			slog.Error("failed to read message from tcp connection", "error", err, "remote", conn.RemoteAddr())
-			break
+		for _, worker := range s.workers {
+			<-worker.done
 		}
-
-		message, err := Decode(messageBuf)
-		if err != nil {
-			slog.Error("failed to decode message from tcp connection", "error", err, "remote", conn.RemoteAddr())
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+		return nil
+	case <-ctx.Done():
+		slog.Warn("shutdown deadline reached, cancelling in-flight queries")
+		for _, worker := range s.workers {
+			worker.cancel()
 		}
+		return ctx.Err()
+	}
+}
 
-		job := workerJob{
-			message: message,
-			responder: func(m *Message) {
-				writeChann <- m
-			},
-		}
-		s.submitJob(job)
+func (s *Server) loadCacheSnapshot() {
+	path := s.config.cacheSnapshotPath
+	err := LoadCacheSnapshot(path, s.authorityCache, s.resourceCache)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("no cache snapshot found", "path", path)
+	} else if err != nil {
+		slog.Warn("failed to load cache snapshot, starting with empty caches", "path", path, "error", err)
+	} else {
+		slog.Info("loaded cache snapshot", "path", path)
 	}
 }
 
-func (s *Server) tcpWriter(ctx context.Context, conn net.Conn, receiver <-chan *Message) {
+func (s *Server) saveCacheSnapshot() {
+	path := s.config.cacheSnapshotPath
+	if err := SaveCacheSnapshot(path, s.authorityCache, s.resourceCache); err != nil {
+		slog.Warn("failed to save cache snapshot", "path", path, "error", err)
+	} else {
+		slog.Debug("saved cache snapshot", "path", path)
+	}
+}
+
+func (s *Server) runCacheSnapshots() {
+	ticker := time.NewTicker(s.config.cacheSnapshotInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ctx.Done():
+		case <-s.ctx.Done():
 			return
-		case msg := <-receiver:
-			encoded := EncodeOrServerError(msg, MessageSizeLimitTCP)
-			if _, err := conn.Write(encoded); err != nil {
-				slog.Error("failed to write to tcp connection", "error", err, "remote", conn.RemoteAddr())
-				conn.Close()
-				return
-			}
+		case <-ticker.C:
+			s.saveCacheSnapshot()
 		}
 	}
 }
 
-func (s *Server) udpReader(conn net.PacketConn) {
-	defer conn.Close()
+// the entries of the record cache
+func (s *Server) CacheEntries() []CachedResource {
+	return s.resourceCache.Entries()
+}
 
-	writeChann := make(chan messageWithAddr)
-	go s.udpWriter(conn, writeChann)
+// the entries of the delegation cache
+func (s *Server) AuthorityCacheEntries() []CachedAuthority {
+	return s.authorityCache.Entries()
+}
 
-	for {
-		buf := make([]byte, MAX_UDP_MESSAGE_SIZE)
-		_, addr, err := conn.ReadFrom(buf)
-		if err != nil {
-			slog.Warn("failed to read udp message", "error", err)
-			continue
-		}
+// the cached records of every type for a name
+func (s *Server) LookupCache(name string) []CachedResource {
+	return s.resourceCache.Lookup(name)
+}
 
-		message, err := Decode(buf)
-		if err != nil {
-			slog.Error("failed to decode message from udp packet", "error", err, "remote", addr)
-			continue
-		}
+// remove the records of the given name and type from the cache
+func (s *Server) FlushCache(name string, ty uint16) {
+	s.resourceCache.Flush(name, ty)
+}
 
-		job := workerJob{
-			message: message,
-			responder: func(m *Message) {
-				writeChann <- messageWithAddr{
-					message: m,
-					addr:    addr,
-				}
-			},
-		}
-		s.submitJob(job)
+// remove every cached record and delegation at or below name. "*.example.com" is the same as "example.com".
+func (s *Server) FlushCacheSubtree(name string) {
+	s.resourceCache.FlushSubtree(name)
+	s.authorityCache.FlushSubtree(name)
+}
+
+// remove every cached record and delegation
+func (s *Server) FlushAllCaches() {
+	s.resourceCache.FlushAll()
+	s.authorityCache.FlushAll()
+}
+
+// the delegations that are currently considered lame and are being skipped
+func (s *Server) LameDelegations() []LameDelegation {
+	return s.lameCache.Entries()
+}
+
+// the state of the queue shared by the workers
+func (s *Server) SchedulerStats() SchedulerStats {
+	stats := s.scheduler.stats()
+	stats.Workers = s.config.workers
+	return stats
+}
+
+func (s *Server) prefetch(domain string, ty uint16) bool {
+	return s.scheduler.submitPrefetch(domain, ty)
+}
+
+func (s *Server) submitJob(job workerJob) {
+	s.scheduler.submit(job)
+}
+
+// the acl of a listener, the server acl if the listener has none
+func (s *Server) aclOf(config listenerConfig) *Acl {
+	if config.acl != nil {
+		return config.acl
 	}
+	return &s.config.acl
 }
 
-func (s *Server) udpWriter(conn net.PacketConn, receiver <-chan messageWithAddr) {
-	for {
-		select {
-		case <-s.ctx.Done():
+// the counters of the clients tracked by the client limits, sorted by the number of queries.
+// empty if client limits are disabled.
+func (s *Server) ClientStats() []ClientStats {
+	if s.clientLimiter == nil {
+		return nil
+	}
+	return s.clientLimiter.stats()
+}
+
+// submit the query of a client allowed by the acl and within its limits, answering or dropping it otherwise
+func (s *Server) submitQuery(action AclAction, job workerJob) {
+	if s.clientLimiter != nil && (action == AclAllow || action == AclCacheOnly) {
+		release, ok := s.clientLimiter.admit(job.client.Addr())
+		if !ok {
+			job.responder(createErrorResponseMessage(job.message, RCODE_REFUSED))
 			return
-		case msg := <-receiver:
-			encoded := EncodeOrServerError(msg.message, MessageSizeLimitUDP)
-			if _, err := conn.WriteTo(encoded, msg.addr); err != nil {
-				slog.Warn("failed to write udp response", "error", err, "remote", msg.addr)
-			}
 		}
+		job.done = release
+	}
+
+	switch action {
+	case AclAllow:
+		s.submitJob(job)
+	case AclCacheOnly:
+		job.cacheOnly = true
+		s.submitJob(job)
+	case AclRefuse:
+		slog.Debug("refusing query", "client", job.client)
+		job.responder(createErrorResponseMessage(job.message, RCODE_REFUSED))
+	default:
+		slog.Debug("dropping query", "client", job.client)
+		job.responder(nil)
 	}
 }
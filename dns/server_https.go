@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const dohPath = "/dns-query"
+const dohContentType = "application/dns-message"
+const dohJsonContentType = "application/dns-json"
+const maxDohMessageSize = 65535
+
+var errDohBadRequest = fmt.Errorf("invalid dns over https request")
+var errDohMethodNotAllowed = fmt.Errorf("%w: method not allowed", errDohBadRequest)
+var errDohUnsupportedMediaType = fmt.Errorf("%w: unsupported media type", errDohBadRequest)
+
+// the json response format popularized by public resolvers, for debugging
+type dohJsonResponse struct {
+	Status    uint8             `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJsonQuestion `json:"Question"`
+	Answer    []dohJsonRecord   `json:"Answer,omitempty"`
+	Authority []dohJsonRecord   `json:"Authority,omitempty"`
+}
+
+type dohJsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJsonRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// listen for dns over https (RFC 8484) on the given address. http/2 is negotiated with clients
+// that support it.
+func (s *Server) listenHttps(config listenerConfig) (net.Listener, *http.Server, error) {
+	listener, err := net.Listen("tcp", config.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	acl := s.aclOf(config)
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		s.serveDoh(w, r, acl)
+	})
+	server := &http.Server{
+		Handler:     mux,
+		IdleTimeout: s.config.tcpLimits.IdleTimeout,
+		TLSConfig: &tls.Config{
+			GetCertificate: config.certificates.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+	return listener, server, nil
+}
+
+func (s *Server) serveDoh(w http.ResponseWriter, r *http.Request, acl *Acl) {
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	action := acl.Action(client.Addr())
+	if action == AclDrop {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !s.trackConnection() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.connections.Done()
+
+	query, jsonFormat, err := parseDohRequest(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errDohMethodNotAllowed) {
+			status = http.StatusMethodNotAllowed
+		} else if errors.Is(err, errDohUnsupportedMediaType) {
+			status = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	responses := make(chan *Message, 1)
+	s.submitQuery(action, workerJob{
+		message:   query,
+		client:    client,
+		responder: func(m *Message) { responses <- m },
+	})
+
+	var response *Message
+	select {
+	case response = <-responses:
+	case <-r.Context().Done():
+		return
+	case <-s.ctx.Done():
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if response == nil {
+		http.Error(w, "server is overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(response)))
+	if jsonFormat {
+		w.Header().Set("Content-Type", dohJsonContentType)
+		json.NewEncoder(w).Encode(newDohJsonResponse(response))
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(EncodeOrServerError(response, MessageSizeLimitTCP))
+}
+
+// the query of a doh request and whether the response should use the json format
+func parseDohRequest(r *http.Request) (*Message, bool, error) {
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		if params.Has("name") {
+			query, err := parseDohJsonQuery(params.Get("name"), params.Get("type"))
+			return query, true, err
+		}
+		encoded := strings.TrimRight(params.Get("dns"), "=")
+		if encoded == "" {
+			return nil, false, fmt.Errorf("%w: missing dns parameter", errDohBadRequest)
+		}
+		wire, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", errDohBadRequest, err)
+		}
+		query, err := Decode(wire)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", errDohBadRequest, err)
+		}
+		return query, acceptsDohJson(r), nil
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			return nil, false, errDohUnsupportedMediaType
+		}
+		wire, err := io.ReadAll(io.LimitReader(r.Body, maxDohMessageSize+1))
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", errDohBadRequest, err)
+		}
+		if len(wire) > maxDohMessageSize {
+			return nil, false, fmt.Errorf("%w: message too large", errDohBadRequest)
+		}
+		query, err := Decode(wire)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", errDohBadRequest, err)
+		}
+		return query, acceptsDohJson(r), nil
+	default:
+		return nil, false, errDohMethodNotAllowed
+	}
+}
+
+func acceptsDohJson(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), dohJsonContentType)
+}
+
+// a query for the name and type parameters of the json api, the type is a number or a mnemonic and defaults to A
+func parseDohJsonQuery(name string, ty string) (*Message, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" && ty == "" {
+		return nil, fmt.Errorf("%w: missing name parameter", errDohBadRequest)
+	}
+	qtype := TYPE_A
+	if ty != "" {
+		if n, err := strconv.ParseUint(ty, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if parsed, ok := parseType(ty); ok {
+			qtype = parsed
+		} else {
+			return nil, fmt.Errorf("%w: invalid type %v", errDohBadRequest, ty)
+		}
+	}
+	query := newQuery(name, qtype)
+	query.Header.RecursionDesired = true
+	return query, nil
+}
+
+func newDohJsonResponse(m *Message) *dohJsonResponse {
+	response := &dohJsonResponse{
+		Status:   m.Header.ResponseCode,
+		TC:       m.Header.Truncated,
+		RD:       m.Header.RecursionDesired,
+		RA:       m.Header.RecursionAvailable,
+		Question: make([]dohJsonQuestion, 0, len(m.Questions)),
+	}
+	for _, q := range m.Questions {
+		response.Question = append(response.Question, dohJsonQuestion{Name: q.Name + ".", Type: q.Type})
+	}
+	records := func(rrs []RR) []dohJsonRecord {
+		converted := make([]dohJsonRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			converted = append(converted, dohJsonRecord{Name: rr.Name + ".", Type: rr.Type, TTL: rr.TTL, Data: rr.Data.String()})
+		}
+		return converted
+	}
+	response.Answer = records(m.Answers)
+	response.Authority = records(m.Authority)
+	return response
+}
+
+// how long a response may be cached by http caches, the smallest ttl of the answer section or of
+// the authority section of negative answers (RFC 8484 section 5.1). failures are not cached.
+func dohMaxAge(m *Message) uint32 {
+	if m.Header.ResponseCode != RCODE_NO_ERROR && m.Header.ResponseCode != RCODE_NAME_ERROR {
+		return 0
+	}
+	records := m.Answers
+	if len(records) == 0 {
+		records = m.Authority
+	}
+	if len(records) == 0 {
+		return 0
+	}
+	maxAge := records[0].TTL
+	for _, rr := range records[1:] {
+		maxAge = min(maxAge, rr.TTL)
+	}
+	return maxAge
+}
@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServerHttps(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir(), 1)
+	server := newTestServer(t, newFakeHierarchy(t), WithHttpsListener("127.0.0.1:0", certFile, keyFile))
+
+	listener, httpServer, err := server.listenHttps(server.config.httpsListeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go httpServer.ServeTLS(listener, "", "")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	url := "https://" + listener.Addr().String() + dohPath
+
+	// returns the decoded response and its max-age
+	check := func(resp *http.Response, err error) (*Message, int) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert(t, resp.StatusCode, http.StatusOK)
+		assert(t, resp.ProtoMajor, 2)
+		assert(t, resp.Header.Get("Content-Type"), dohContentType)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Decode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxAge, err := strconv.Atoi(strings.TrimPrefix(resp.Header.Get("Cache-Control"), "max-age="))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, maxAge
+	}
+
+	query := newQuery("www.example.com", TYPE_A)
+	query.Header.Id = 0
+	encoded, err := Encode(query, MessageSizeLimitTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, maxAge := check(client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(encoded)))
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, maxAge, 300)
+
+	resp, maxAge = check(client.Post(url, dohContentType, bytes.NewReader(encoded)))
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, maxAge > 0 && maxAge <= 300, true)
+
+	// browsers send an OPT record padded to a block size (RFC 8467)
+	padded := newQuery("www.example.com", TYPE_A)
+	padded.Header.Id = 0
+	padded.Header.RecursionDesired = true
+	padded.Additional = []RR{{
+		RR_Header: RR_Header{Name: rootZone, Type: TYPE_OPT, Class: 4096},
+		Data:      &RR_Unknown{Data: append([]byte{0, 12, 0, 100}, make([]byte, 100)...)},
+	}}
+	padded.Header.AdditionalCount = 1
+	encodedPadded, err := Encode(padded, MessageSizeLimitTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = check(client.Post(url, dohContentType, bytes.NewReader(encodedPadded)))
+	assert(t, resp.Header.ResponseCode, RCODE_NO_ERROR)
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, len(resp.Additional), 1)
+	assert(t, resp.Additional[0].Type, TYPE_OPT)
+
+	// json api
+	jsonResp, err := client.Get(url + "?name=example.com&type=MX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonResp.Body.Close()
+	assert(t, jsonResp.Header.Get("Content-Type"), dohJsonContentType)
+	decoded := dohJsonResponse{}
+	if err := json.NewDecoder(jsonResp.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, decoded.Status, RCODE_NO_ERROR)
+	assert(t, decoded.Question[0].Name, "example.com.")
+	assert(t, len(decoded.Answer), 1)
+	assert(t, decoded.Answer[0].Data, "10 mail.example.com")
+
+	// invalid requests
+	for _, c := range []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusBadRequest},
+		{http.MethodGet, "?dns=%21%21", http.StatusBadRequest},
+		{http.MethodPut, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", http.StatusUnsupportedMediaType},
+	} {
+		req, _ := http.NewRequest(c.method, url+c.query, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert(t, resp.StatusCode, c.status, c.method, c.query)
+	}
+}
@@ -1,19 +1,150 @@
 package dns
 
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
 func applyDefaultServerConfig(config *ServerConfig) {
-	config.workers = 8
+	config.workers = defaultWorkers
+	config.queueSize = defaultQueueSize
+	config.overloadAction = OverloadServerFailure
+	config.tcpLimits = DefaultTcpLimits()
+	config.acl = DefaultAcl()
+	config.resolver.AddressFamily = AddressFamilyAny
+	config.resolver.RootPrimingInterval = defaultRootPrimingInterval
+	config.resolver.RecursionLimits = DefaultRecursionLimits()
+	config.resolver.StaleAnswerTimeout = defaultStaleAnswerTimeout
+	config.resolver.Transport = &TcpPool{}
+}
+
+type ListenerOption func(*listenerConfig) error
+
+type listenerConfig struct {
+	addr string
+	// nil to use the acl of the server
+	acl *Acl
+	// the certificate of tls and https listeners
+	certificates *certificateReloader
+	// number of sockets of udp listeners
+	sockets int
+}
+
+func newListenerConfig(addr string, opts []ListenerOption) (listenerConfig, error) {
+	config := listenerConfig{addr: addr}
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return listenerConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+// decide what to do with the queries received by the listener instead of using the acl of the server
+func WithListenerAcl(acl Acl) ListenerOption {
+	return func(lc *listenerConfig) error {
+		if err := acl.validate(); err != nil {
+			return err
+		}
+		lc.acl = &acl
+		return nil
+	}
+}
+
+// open n sockets for a udp listener, bound to the same address with SO_REUSEPORT, each read
+// by its own goroutine so packet i/o is spread over multiple cores. the queries of every socket
+// are still resolved by the workers of the shared queue.
+func WithSockets(n int) ListenerOption {
+	return func(lc *listenerConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid number of sockets: %v", n)
+		}
+		if n > 1 && !reusePortSupported {
+			return ErrReusePortUnsupported
+		}
+		lc.sockets = n
+		return nil
+	}
+}
+
+func WithTcpListener(addr string, opts ...ListenerOption) ServerOption {
+	return func(sc *ServerConfig) error {
+		config, err := newListenerConfig(addr, opts)
+		if err != nil {
+			return err
+		}
+		sc.tcpListeners = append(sc.tcpListeners, config)
+		return nil
+	}
+}
+
+func WithUdpListener(addr string, opts ...ListenerOption) ServerOption {
+	return func(sc *ServerConfig) error {
+		config, err := newListenerConfig(addr, opts)
+		if err != nil {
+			return err
+		}
+		sc.udpListeners = append(sc.udpListeners, config)
+		return nil
+	}
+}
+
+// serve dns over tls (RFC 7858) on addr, usually port 853. the certificate is reloaded
+// when the files change, tcp limits also apply to tls connections.
+func WithTlsListener(addr string, certFile string, keyFile string, opts ...ListenerOption) ServerOption {
+	return func(sc *ServerConfig) error {
+		config, err := newListenerConfig(addr, opts)
+		if err != nil {
+			return err
+		}
+		config.certificates, err = newCertificateReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		sc.tlsListeners = append(sc.tlsListeners, config)
+		return nil
+	}
 }
 
-func WithTcpListener(addr string) ServerOption {
+// serve dns over https (RFC 8484) on addr at /dns-query, usually port 443. the json api is
+// also served for debugging. the certificate is reloaded when the files change.
+func WithHttpsListener(addr string, certFile string, keyFile string, opts ...ListenerOption) ServerOption {
 	return func(sc *ServerConfig) error {
-		sc.tcpAddresses = append(sc.tcpAddresses, addr)
+		config, err := newListenerConfig(addr, opts)
+		if err != nil {
+			return err
+		}
+		config.certificates, err = newCertificateReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		sc.httpsListeners = append(sc.httpsListeners, config)
 		return nil
 	}
 }
 
-func WithUdpListener(addr string) ServerOption {
+// decide what to do with the queries of each client by its address, on listeners without their
+// own acl. defaults to DefaultAcl, which only allows loopback and private networks.
+func WithAcl(acl Acl) ServerOption {
 	return func(sc *ServerConfig) error {
-		sc.udpAddresses = append(sc.udpAddresses, addr)
+		if err := acl.validate(); err != nil {
+			return err
+		}
+		sc.acl = acl
+		return nil
+	}
+}
+
+// limit the connections and queries of tcp clients
+func WithTcpLimits(limits TcpLimits) ServerOption {
+	return func(sc *ServerConfig) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		sc.tcpLimits = limits
 		return nil
 	}
 }
@@ -24,3 +155,220 @@ func WithWorkers(n int) ServerOption {
 		return nil
 	}
 }
+
+// bound the number of queries waiting for a worker. queries that arrive while the queue is
+// full are shed according to action instead of waiting.
+func WithQueue(size int, action OverloadAction) ServerOption {
+	return func(sc *ServerConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid queue size: %v", size)
+		}
+		switch action {
+		case OverloadServerFailure, OverloadRefused, OverloadDrop:
+		default:
+			return fmt.Errorf("invalid overload action: %v", action)
+		}
+		sc.queueSize = size
+		sc.overloadAction = action
+		return nil
+	}
+}
+
+func WithAddressFamily(family AddressFamily) ServerOption {
+	return func(sc *ServerConfig) error {
+		switch family {
+		case AddressFamilyAny, AddressFamilyIpv4, AddressFamilyIpv6:
+		default:
+			return fmt.Errorf("invalid address family: %v", family)
+		}
+		sc.resolver.AddressFamily = family
+		return nil
+	}
+}
+
+// load the root hints from a file in the named.root format.
+// if the file does not exist the built-in hints are used.
+func WithRootHints(path string) ServerOption {
+	return func(sc *ServerConfig) error {
+		hints, err := LoadRootHints(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("root hints file not found, using built-in hints", "path", path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load root hints from %v: %w", path, err)
+		}
+		sc.resolver.RootHints = hints
+		return nil
+	}
+}
+
+// how often the root nameservers are refreshed with a priming query.
+// the root nameserver set is also refreshed earlier if its ttl expires.
+func WithRootPrimingInterval(interval time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid root priming interval: %v", interval)
+		}
+		sc.resolver.RootPrimingInterval = interval
+		return nil
+	}
+}
+
+func WithRecursionLimits(limits RecursionLimits) ServerOption {
+	return func(sc *ServerConfig) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		sc.resolver.RecursionLimits = limits
+		return nil
+	}
+}
+
+// serve expired records for up to window after they expire when the authoritative
+// servers cannot be reached (RFC 8767). stale records are also returned if resolution
+// takes longer than clientTimeout, with the resolution continuing in the background.
+func WithServeStale(window time.Duration, clientTimeout time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		if window <= 0 || clientTimeout <= 0 {
+			return fmt.Errorf("invalid serve-stale configuration: window=%v timeout=%v", window, clientTimeout)
+		}
+		sc.resourceCache.StaleWindow = window
+		sc.resolver.ServeStale = true
+		sc.resolver.StaleAnswerTimeout = clientTimeout
+		return nil
+	}
+}
+
+// refresh entries that were hit at least minHits times before they expire
+func WithPrefetch(minHits int) ServerOption {
+	return func(sc *ServerConfig) error {
+		if minHits <= 0 {
+			return fmt.Errorf("invalid prefetch minimum hits: %v", minHits)
+		}
+		sc.prefetch = true
+		sc.resourceCache.PrefetchMinHits = minHits
+		return nil
+	}
+}
+
+// clamp the ttl of cached positive answers. a zero bound is not applied.
+func WithTTLBounds(minTTL time.Duration, maxTTL time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		bounds, err := newTTLBounds(minTTL, maxTTL)
+		if err != nil {
+			return err
+		}
+		sc.resourceCache.TTL = bounds
+		return nil
+	}
+}
+
+// clamp the ttl of cached negative answers. a zero bound is not applied.
+func WithNegativeTTLBounds(minTTL time.Duration, maxTTL time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		bounds, err := newTTLBounds(minTTL, maxTTL)
+		if err != nil {
+			return err
+		}
+		sc.resourceCache.NegativeTTL = bounds
+		return nil
+	}
+}
+
+// clamp the ttl of cached positive answers of the given type, overriding WithTTLBounds.
+func WithTypeTTLBounds(ty uint16, minTTL time.Duration, maxTTL time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		bounds, err := newTTLBounds(minTTL, maxTTL)
+		if err != nil {
+			return err
+		}
+		if sc.resourceCache.TypeTTL == nil {
+			sc.resourceCache.TypeTTL = make(map[uint16]TTLBounds)
+		}
+		sc.resourceCache.TypeTTL[ty] = bounds
+		return nil
+	}
+}
+
+// clamp the ttl of cached positive answers at or below the given zone, overriding
+// WithTTLBounds and WithTypeTTLBounds.
+func WithZoneTTLBounds(zone string, minTTL time.Duration, maxTTL time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		bounds, err := newTTLBounds(minTTL, maxTTL)
+		if err != nil {
+			return err
+		}
+		if sc.resourceCache.ZoneTTL == nil {
+			sc.resourceCache.ZoneTTL = make(map[string]TTLBounds)
+		}
+		sc.resourceCache.ZoneTTL[zone] = bounds
+		return nil
+	}
+}
+
+func newTTLBounds(minTTL time.Duration, maxTTL time.Duration) (TTLBounds, error) {
+	if minTTL < 0 || maxTTL < 0 || (maxTTL > 0 && minTTL > maxTTL) {
+		return TTLBounds{}, fmt.Errorf("invalid ttl bounds: min=%v max=%v", minTTL, maxTTL)
+	}
+	return TTLBounds{Min: minTTL, Max: maxTTL}, nil
+}
+
+// persist the caches to path on shutdown and every interval, and load them on startup.
+func WithCacheSnapshot(path string, interval time.Duration) ServerOption {
+	return func(sc *ServerConfig) error {
+		if path == "" || interval <= 0 {
+			return fmt.Errorf("invalid cache snapshot configuration: path=%v interval=%v", path, interval)
+		}
+		sc.cacheSnapshotPath = path
+		sc.cacheSnapshotInterval = interval
+		return nil
+	}
+}
+
+// forward queries to the given recursive servers, tried in order, instead of resolving them from the root.
+func WithForwarders(upstreams ...UpstreamConfig) ServerOption {
+	return func(sc *ServerConfig) error {
+		for _, config := range upstreams {
+			upstream, err := NewUpstream(config)
+			if err != nil {
+				return err
+			}
+			sc.resolver.Forwarders = append(sc.resolver.Forwarders, upstream)
+		}
+		return nil
+	}
+}
+
+// limit the rate of udp responses to each client network (response rate limiting).
+func WithResponseRateLimit(config RateLimitConfig) ServerOption {
+	return func(sc *ServerConfig) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		sc.rateLimit = &config
+		return nil
+	}
+}
+
+// limit the queries each client can send and have resolved at the same time.
+func WithClientLimits(limits ClientLimits) ServerOption {
+	return func(sc *ServerConfig) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		sc.clientLimits = &limits
+		return nil
+	}
+}
+
+// send all upstream queries through transport instead of pooled tcp connections.
+func WithTransport(transport Transport) ServerOption {
+	return func(sc *ServerConfig) error {
+		if transport == nil {
+			return fmt.Errorf("transport must not be nil")
+		}
+		sc.resolver.Transport = transport
+		return nil
+	}
+}
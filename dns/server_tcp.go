@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// delay before accepting again after a failed accept, doubled on every consecutive failure
+const minAcceptRetryDelay = 5 * time.Millisecond
+const maxAcceptRetryDelay = time.Second
+
+// TcpLimits bound the resources used by tcp clients (RFC 7766 section 6.2).
+type TcpLimits struct {
+	// how long a connection may stay open without the client sending a query
+	IdleTimeout time.Duration
+	// maximum number of connections open at the same time, new connections are closed once reached
+	MaxConnections int
+	// maximum number of queries answered on a single connection before it is closed
+	MaxQueriesPerConnection int
+	// maximum number of pipelined queries being resolved at the same time on a single connection
+	MaxPipelinedQueries int
+}
+
+func DefaultTcpLimits() TcpLimits {
+	return TcpLimits{
+		IdleTimeout:             10 * time.Second,
+		MaxConnections:          256,
+		MaxQueriesPerConnection: 1024,
+		MaxPipelinedQueries:     32,
+	}
+}
+
+func (l *TcpLimits) validate() error {
+	if l.IdleTimeout <= 0 || l.MaxConnections <= 0 || l.MaxQueriesPerConnection <= 0 || l.MaxPipelinedQueries <= 0 {
+		return fmt.Errorf("invalid tcp limits: all limits must be positive: %+v", *l)
+	}
+	return nil
+}
+
+func (s *Server) receiverTcp(listener net.Listener, acl *Acl) {
+	limits := s.config.tcpLimits
+	connections := make(chan struct{}, limits.MaxConnections)
+	delay := time.Duration(0)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			delay = min(max(delay*2, minAcceptRetryDelay), maxAcceptRetryDelay)
+			slog.Warn("failed to accept tcp connection", "error", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		action := acl.Action(clientAddrOf(conn.RemoteAddr()).Addr())
+		if action == AclDrop {
+			slog.Debug("dropping tcp connection", "remote", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		select {
+		case connections <- struct{}{}:
+		default:
+			slog.Warn("too many tcp connections, closing new connection", "remote", conn.RemoteAddr(), "max", limits.MaxConnections)
+			conn.Close()
+			continue
+		}
+
+		if !s.trackConnection() {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.connections.Done()
+			defer func() { <-connections }()
+			s.serveTcp(conn, action)
+		}()
+	}
+}
+
+// register a new tcp connection or https request, fails if the server is shutting down
+func (s *Server) trackConnection() bool {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+	if s.draining.Err() != nil {
+		return false
+	}
+	s.connections.Add(1)
+	return true
+}
+
+// answer the queries sent on conn according to the acl action of the client. queries are resolved
+// concurrently and their responses are written as soon as they are ready, possibly out of order.
+func (s *Server) serveTcp(conn net.Conn, action AclAction) {
+	limits := s.config.tcpLimits
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	// stop reading queries when the server starts shutting down
+	stopReading := context.AfterFunc(s.draining, func() { conn.SetReadDeadline(time.Now()) })
+	defer stopReading()
+
+	// the channel has room for every pipelined query so workers never block on a slow client
+	responses := make(chan []byte, limits.MaxPipelinedQueries)
+	pipelined := make(chan struct{}, limits.MaxPipelinedQueries)
+	pending := sync.WaitGroup{}
+	go s.tcpWriter(ctx, cancel, conn, responses, pipelined, &pending)
+
+	client := clientAddrOf(conn.RemoteAddr())
+	respond := func(encoded []byte) {
+		responses <- encoded
+	}
+
+	for queries := 0; queries < limits.MaxQueriesPerConnection; queries++ {
+		if err := conn.SetReadDeadline(time.Now().Add(limits.IdleTimeout)); err != nil || s.draining.Err() != nil {
+			break
+		}
+		frame, err := readTcpFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Warn("failed to read from tcp connection", "error", err, "remote", conn.RemoteAddr())
+			}
+			break
+		}
+
+		select {
+		case pipelined <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		pending.Add(1)
+
+		message, err := Decode(frame)
+		if err != nil {
+			slog.Warn("failed to decode message from tcp connection", "error", err, "remote", conn.RemoteAddr())
+			respond(formatErrorResponse(frame))
+			continue
+		}
+
+		s.submitQuery(action, workerJob{
+			message: message,
+			client:  client,
+			responder: func(m *Message) {
+				if m == nil {
+					// release the slot of the dropped query without writing anything
+					respond(nil)
+					return
+				}
+				respond(EncodeOrServerError(m, MessageSizeLimitTCP))
+			},
+		})
+	}
+
+	// stop reading but let the client receive the answers to the queries it already sent
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// write the responses to conn until the connection fails or ctx is cancelled. a nil response
+// only releases the slot of a dropped query.
+func (s *Server) tcpWriter(ctx context.Context, cancel context.CancelFunc, conn net.Conn, responses <-chan []byte, pipelined <-chan struct{}, pending *sync.WaitGroup) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case encoded := <-responses:
+			var err error
+			if encoded != nil {
+				conn.SetWriteDeadline(time.Now().Add(s.config.tcpLimits.IdleTimeout))
+				err = writeTcpFrame(conn, encoded)
+			}
+			<-pipelined
+			pending.Done()
+			if err != nil {
+				slog.Warn("failed to write to tcp connection", "error", err, "remote", conn.RemoteAddr())
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// a FORMERR response to a message that could not be decoded, with the id of the message if it has one
+func formatErrorResponse(frame []byte) []byte {
+	msg := &Message{}
+	if len(frame) >= 2 {
+		msg.Header.Id = binary.BigEndian.Uint16(frame)
+	}
+	return EncodeOrServerError(createErrorResponseMessage(msg, RCODE_FORMAT_ERROR), MessageSizeLimitTCP)
+}
@@ -0,0 +1,386 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a server resolving through the fake hierarchy, with its workers running but no listeners
+func newTestServer(t testing.TB, network *fakeNetwork, opts ...ServerOption) *Server {
+	hints := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(hints, []byte(`
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = append([]ServerOption{WithRootHints(hints), WithTransport(network)}, opts...)
+	server, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.startWorkers()
+	t.Cleanup(server.Finish)
+	return server
+}
+
+func TestServerTcp(t *testing.T) {
+	limits := DefaultTcpLimits()
+	limits.IdleTimeout = 200 * time.Millisecond
+	limits.MaxQueriesPerConnection = 3
+	server := newTestServer(t, newFakeHierarchy(t), WithTcpLimits(limits))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		server.receiverTcp(listener, &server.config.acl)
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// pipeline two queries and a malformed message in a single write
+	q1 := newQuery("www.example.com", TYPE_A)
+	q2 := newQuery("www.example.net", TYPE_A)
+	stream := make([]byte, 0)
+	for _, q := range []*Message{q1, q2} {
+		encoded, err := Encode(q, MessageSizeLimitTCP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, byte(len(encoded)>>8), byte(len(encoded)))
+		stream = append(stream, encoded...)
+	}
+	stream = append(stream, 0, 3, 0xab, 0xcd, 0xff)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answers := make(map[uint16]*Message)
+	for i := 0; i < 3; i++ {
+		resp, err := readTcpMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers[resp.Header.Id] = resp
+	}
+	assert(t, len(answers[q1.Header.Id].Answers), 1)
+	assert(t, len(answers[q2.Header.Id].Answers), 1)
+	assert(t, answers[0xabcd].Header.ResponseCode, RCODE_FORMAT_ERROR)
+
+	// the connection is closed after the maximum number of queries
+	if _, err := readTcpMessage(conn); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	// idle connections are closed
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readTcpMessage(idle); err == nil || os.IsTimeout(err) {
+		t.Fatalf("expected the idle connection to be closed by the server: %v", err)
+	}
+
+	listener.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tcp receiver did not stop after the listener was closed")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t))
+
+	responses := make(chan *Message, 16)
+	for _, name := range []string{"www.example.com", "mail.example.com", "www.example.net", "missing.example.com"} {
+		server.submitJob(workerJob{
+			message:   newQuery(name, TYPE_A),
+			responder: func(m *Message) { responses <- m },
+		})
+	}
+
+	// queued queries are answered before the shutdown completes
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(responses), 4)
+	for i := 0; i < 4; i++ {
+		resp := <-responses
+		assert(t, resp.Header.ResponseCode != RCODE_SERVER_FAILURE, true)
+	}
+
+	// queries still being resolved when the deadline is reached are cancelled
+	network := newFakeHierarchy(t)
+	network.server("198.41.0.4").delay = time.Minute
+	server = newTestServer(t, network)
+	server.submitJob(workerJob{
+		message:   newQuery("www.example.com", TYPE_A),
+		responder: func(m *Message) { responses <- m },
+	})
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert(t, errors.Is(err, context.DeadlineExceeded), true)
+	select {
+	case resp := <-responses:
+		assert(t, resp.Header.ResponseCode, RCODE_SERVER_FAILURE)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled query was not answered")
+	}
+}
+
+// a buffer that can be written concurrently, to capture logs
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerFinish(t *testing.T) {
+	logs := &lockedBuffer{}
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	defer slog.SetDefault(logger)
+
+	network := newFakeHierarchy(t)
+	network.server("198.41.0.4").delay = time.Minute
+	server := newTestServer(t, network)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listeners = append(server.listeners, listener)
+	go server.receiverTcp(listener, &server.config.acl)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeTcpMessage(conn, newQuery("www.example.com", TYPE_A)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SchedulerStats().Busy == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the query was not picked up by a worker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the in-flight query is cancelled and the connection closed without waiting for a deadline
+	server.Finish()
+	assert(t, server.SchedulerStats().Busy, 0)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := readTcpMessage(conn); err != nil {
+			assert(t, os.IsTimeout(err), false, err.Error())
+			break
+		}
+	}
+	assert(t, strings.Contains(logs.String(), "shutdown deadline reached"), false, logs.String())
+
+	// the warning is only logged when the deadline of a graceful shutdown expires
+	server = newTestServer(t, network)
+	server.submitJob(workerJob{
+		message:   newQuery("www.example.com", TYPE_A),
+		responder: func(m *Message) {},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+	assert(t, strings.Contains(logs.String(), "shutdown deadline reached"), true, logs.String())
+}
+
+func TestServerRunShutdown(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t), WithUdpListener("127.0.0.1:0"), WithTcpListener("127.0.0.1:0"))
+
+	result := make(chan error, 1)
+	go func() { result <- server.Run() }()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+}
+
+func TestServerOverload(t *testing.T) {
+	network := newFakeHierarchy(t)
+	network.server("198.41.0.4").delay = time.Minute
+	server := newTestServer(t, network, WithWorkers(1), WithQueue(1, OverloadRefused))
+
+	// the only worker is stuck resolving and the queue has room for a single query,
+	// so queries are shed without blocking the caller
+	responses := make(chan *Message, 16)
+	for i := 0; i < 4; i++ {
+		server.submitJob(workerJob{
+			message:   newQuery("www.example.com", TYPE_A),
+			responder: func(m *Message) { responses <- m },
+		})
+	}
+	stats := server.SchedulerStats()
+	assert(t, stats.Accepted+stats.Shed, uint64(4))
+	assert(t, stats.Shed >= 2, true)
+	assert(t, stats.QueueCapacity, 1)
+	assert(t, stats.Workers, 1)
+	assert(t, len(responses), int(stats.Shed))
+	for i := 0; i < int(stats.Shed); i++ {
+		resp := <-responses
+		assert(t, resp.Header.ResponseCode, RCODE_REFUSED)
+	}
+
+	// prefetches are skipped while the queue is busy
+	assert(t, server.prefetch("www.example.com", TYPE_A), false)
+	assert(t, server.SchedulerStats().PrefetchesSkipped, uint64(1))
+}
+
+func TestServerTcpOverloadDrop(t *testing.T) {
+	network := newFakeHierarchy(t)
+	network.server("198.41.0.4").delay = 200 * time.Millisecond
+	limits := DefaultTcpLimits()
+	limits.IdleTimeout = 200 * time.Millisecond
+	server := newTestServer(t, network, WithWorkers(1), WithQueue(1, OverloadDrop), WithTcpLimits(limits))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.receiverTcp(listener, &server.config.acl)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// pipeline more queries than the worker and the queue can hold, the rest are dropped
+	stream := make([]byte, 0)
+	for i := 0; i < 4; i++ {
+		encoded, err := Encode(newQuery("www.example.com", TYPE_A), MessageSizeLimitTCP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, byte(len(encoded)>>8), byte(len(encoded)))
+		stream = append(stream, encoded...)
+	}
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// the accepted queries are answered and the dropped ones do not keep the connection open
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answered := 0
+	for {
+		resp, err := readTcpMessage(conn)
+		if err != nil {
+			if os.IsTimeout(err) {
+				t.Fatal("expected the connection to be closed after the idle timeout")
+			}
+			break
+		}
+		assert(t, resp.Header.ResponseCode, RCODE_NO_ERROR)
+		answered++
+	}
+	stats := server.SchedulerStats()
+	assert(t, stats.Accepted+stats.Shed, uint64(4))
+	assert(t, stats.Shed >= 2, true)
+	assert(t, answered, int(stats.Accepted))
+}
+
+func TestServerEdns(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t))
+	udpAddr := startUdpListener(t, server, listenerConfig{addr: "127.0.0.1:0"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.receiverTcp(listener, &server.config.acl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// queries with an OPT record are answered with one
+	for _, c := range []struct {
+		net  string
+		addr string
+	}{{"udp", udpAddr}, {"tcp", listener.Addr().String()}} {
+		client := &Client{Net: c.net, UDPSize: DefaultEdnsBufferSize}
+		resp, err := client.Exchange(ctx, newQuery("www.example.com", TYPE_A), c.addr)
+		if err != nil {
+			t.Fatal(c.net, err)
+		}
+		assert(t, resp.Header.ResponseCode, RCODE_NO_ERROR, c.net)
+		assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+		assert(t, len(resp.Additional), 1, c.net)
+		assert(t, resp.Additional[0].Type, TYPE_OPT, c.net)
+		assert(t, resp.Additional[0].Class, uint16(serverEdnsBufferSize), c.net)
+	}
+
+	// unsupported EDNS versions get BADVERS
+	query := newQuery("www.example.com", TYPE_A)
+	query.Additional = []RR{{RR_Header: RR_Header{Name: rootZone, Type: TYPE_OPT, Class: 1232, TTL: 1 << 16}, Data: &RR_Unknown{}}}
+	query.Header.AdditionalCount = 1
+	resp, err := (&Client{}).Exchange(ctx, query, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_NO_ERROR)
+	assert(t, len(resp.Additional), 1)
+	assert(t, uint8(resp.Additional[0].TTL>>24)<<4|resp.Header.ResponseCode, RCODE_BAD_VERSION)
+
+	// any other additional record is still a format error
+	query = newQuery("www.example.com", TYPE_A)
+	query.Additional = []RR{{RR_Header: RR_Header{Name: "www.example.com", Type: TYPE_A, Class: CLASS_IN}, Data: &RR_A{}}}
+	query.Header.AdditionalCount = 1
+	resp, err = (&Client{}).Exchange(ctx, query, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_FORMAT_ERROR)
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// the alpn protocol id of dns over tls (RFC 7858)
+const alpnDoT = "dot"
+
+// how often the certificate files are checked for changes
+const defaultCertificateCheckInterval = 10 * time.Second
+
+// certificateReloader serves a certificate loaded from files and reloads it when the files change.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	// the files are checked at most once per interval
+	checkInterval time.Duration
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	checked     time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile, checkInterval: defaultCertificateCheckInterval}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certificateReloader) reload() error {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = &certificate
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+// the current certificate, reloaded first if the files were modified since they were last
+// checked. if reloading fails the previous certificate keeps being served.
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.checked) < r.checkInterval {
+		defer r.mu.Unlock()
+		return r.certificate, nil
+	}
+	r.checked = now
+	r.mu.Unlock()
+
+	certModTime, keyModTime, err := r.modTimes()
+	r.mu.Lock()
+	changed := err == nil && (!certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime))
+	r.mu.Unlock()
+
+	if changed {
+		if err := r.reload(); err != nil {
+			slog.Warn("failed to reload tls certificate, serving the previous one", "cert", r.certFile, "key", r.keyFile, "error", err)
+		} else {
+			slog.Info("reloaded tls certificate", "cert", r.certFile, "key", r.keyFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.certificate, nil
+}
+
+// listen for dns over tls on the given address. session resumption with tickets is enabled
+// and the ticket keys are rotated by the tls package.
+func (s *Server) listenTls(config listenerConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", config.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: config.certificates.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{alpnDoT},
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate for 127.0.0.1 to dir and return its paths
+func writeTestCertificate(t *testing.T, dir string, serial int64) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes even on filesystems with coarse timestamps
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile, cert
+}
+
+func TestServerTls(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeTestCertificate(t, dir, 1)
+	server := newTestServer(t, newFakeHierarchy(t), WithTlsListener("127.0.0.1:0", certFile, keyFile))
+
+	listener, err := server.listenTls(server.config.tlsListeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.receiverTcp(listener, &server.config.acl)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	clientConfig := &tls.Config{
+		RootCAs:            roots,
+		NextProtos:         []string{"dot"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+
+	query := func(config *tls.Config) tls.ConnectionState {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		q := newQuery("www.example.com", TYPE_A)
+		if err := writeTcpMessage(conn, q); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readTcpMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, resp.Header.Id, q.Header.Id)
+		assert(t, len(resp.Answers), 1)
+		return conn.ConnectionState()
+	}
+
+	state := query(clientConfig)
+	assert(t, state.NegotiatedProtocol, "dot")
+	assert(t, state.DidResume, false)
+
+	// the second connection resumes the session of the first
+	state = query(clientConfig)
+	assert(t, state.DidResume, true)
+
+	// stub resolvers and forwarders send an OPT record
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ednsQuery := (&Client{UDPSize: DefaultEdnsBufferSize}).withEdns(newQuery("www.example.com", TYPE_A))
+	if err := writeTcpMessage(conn, ednsQuery); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readTcpMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.Header.ResponseCode, RCODE_NO_ERROR)
+	assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+	assert(t, len(resp.Additional), 1)
+	assert(t, resp.Additional[0].Type, TYPE_OPT)
+
+	// the files are not checked again until the interval passes
+	certificates := server.config.tlsListeners[0].certificates
+	_, _, renewed := writeTestCertificate(t, dir, 2)
+	roots.AddCert(renewed)
+	state = query(&tls.Config{RootCAs: roots})
+	assert(t, state.PeerCertificates[0].SerialNumber.Int64(), int64(1))
+
+	// the certificate is reloaded once the files change
+	certificates.mu.Lock()
+	certificates.checked = time.Time{}
+	certificates.mu.Unlock()
+	state = query(&tls.Config{RootCAs: roots})
+	assert(t, state.PeerCertificates[0].SerialNumber.Int64(), int64(2))
+}
@@ -0,0 +1,177 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maximum number of packets read or written by a single system call
+const udpBatchSize = 32
+
+// responses waiting to be written on each socket
+const udpWriteQueueSize = 256
+
+// bounds of the delay before reading again from a socket that failed
+const minReadRetryDelay = 5 * time.Millisecond
+const maxReadRetryDelay = time.Second
+
+var ErrReusePortUnsupported = fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+
+// a socket that reads and writes several packets per system call (recvmmsg and sendmmsg)
+// where the platform supports it, and one packet per call elsewhere
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+type udpResponse struct {
+	encoded []byte
+	addr    net.Addr
+}
+
+// open the sockets of a udp listener. with more than one socket they are bound to the same
+// address with SO_REUSEPORT and the kernel spreads the clients between them.
+func listenUdp(config listenerConfig) ([]net.PacketConn, error) {
+	listenConfig := net.ListenConfig{}
+	if config.sockets > 1 {
+		listenConfig.Control = reusePortControl
+	}
+
+	addr := config.addr
+	conns := make([]net.PacketConn, 0, max(config.sockets, 1))
+	for i := 0; i < max(config.sockets, 1); i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		// bind the other sockets to the port chosen for the first one
+		addr = conn.LocalAddr().String()
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func (s *Server) udpReader(conn net.PacketConn, acl *Acl) {
+	batch := newBatchConn(conn)
+	responses := make(chan udpResponse, udpWriteQueueSize)
+	go s.udpWriter(batch, responses)
+
+	// stop reading queries when the server starts shutting down, the socket is closed once
+	// the queued queries are answered
+	stop := context.AfterFunc(s.draining, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	msgs := make([]ipv4.Message, udpBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, MAX_UDP_MESSAGE_SIZE)}
+	}
+
+	delay := time.Duration(0)
+	for {
+		n, err := batch.ReadBatch(msgs, 0)
+		if s.draining.Err() != nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// back off so a socket that keeps failing does not spin
+			delay = min(max(delay*2, minReadRetryDelay), maxReadRetryDelay)
+			slog.Warn("failed to read udp message", "error", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		for _, msg := range msgs[:n] {
+			s.handleUdpPacket(msg.Buffers[0][:msg.N], msg.Addr, acl, responses)
+		}
+	}
+}
+
+func (s *Server) handleUdpPacket(packet []byte, addr net.Addr, acl *Acl, responses chan<- udpResponse) {
+	client := clientAddrOf(addr)
+	action := acl.Action(client.Addr())
+	if action == AclDrop {
+		return
+	}
+
+	// the read buffer is reused, the decoded message must not refer to it
+	message, err := Decode(slices.Clone(packet))
+	if err != nil {
+		slog.Error("failed to decode message from udp packet", "error", err, "remote", addr)
+		return
+	}
+
+	job := workerJob{
+		message: message,
+		client:  client,
+		responder: func(m *Message) {
+			if m == nil {
+				return
+			}
+			if s.rateLimiter != nil {
+				switch s.rateLimiter.check(client.Addr(), m) {
+				case rateLimitDrop:
+					return
+				case rateLimitSlip:
+					m = truncatedResponse(m)
+				}
+			}
+			// never block the worker on a slow socket, the client retries like after any lost packet
+			select {
+			case responses <- udpResponse{encoded: EncodeOrServerError(m, MessageSizeLimitUDP), addr: addr}:
+			default:
+				slog.Debug("udp write queue full, dropping response", "remote", addr)
+			}
+		},
+	}
+	s.submitQuery(action, job)
+}
+
+// write the responses queued for a socket, batching the ones that are ready together
+func (s *Server) udpWriter(conn batchConn, responses <-chan udpResponse) {
+	msgs := make([]ipv4.Message, 0, udpBatchSize)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case response := <-responses:
+			msgs = append(msgs[:0], ipv4.Message{Buffers: [][]byte{response.encoded}, Addr: response.addr})
+		collect:
+			for len(msgs) < udpBatchSize {
+				select {
+				case response := <-responses:
+					msgs = append(msgs, ipv4.Message{Buffers: [][]byte{response.encoded}, Addr: response.addr})
+				default:
+					break collect
+				}
+			}
+
+			for sent := 0; sent < len(msgs); {
+				n, err := conn.WriteBatch(msgs[sent:], 0)
+				if err != nil {
+					// skip the response that failed
+					slog.Warn("failed to write udp response", "error", err, "remote", msgs[sent+n].Addr)
+					n += 1
+				}
+				sent += n
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// start udp readers for the listener and return the address they listen on
+func startUdpListener(t testing.TB, server *Server, config listenerConfig) string {
+	conns, err := listenUdp(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		t.Cleanup(func() { conn.Close() })
+		go server.udpReader(conn, &server.config.acl)
+	}
+	return conns[0].LocalAddr().String()
+}
+
+func TestServerUdpSockets(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t))
+
+	conns, err := listenUdp(listenerConfig{addr: "127.0.0.1:0", sockets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(conns), 4)
+	for _, conn := range conns {
+		assert(t, conn.LocalAddr().String(), conns[0].LocalAddr().String())
+		conn.Close()
+	}
+
+	addr := startUdpListener(t, server, listenerConfig{addr: "127.0.0.1:0", sockets: 4})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// clients on different ports are spread over the sockets and all answered
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &Client{}
+			resp, err := client.Exchange(ctx, newQuery("www.example.com", TYPE_A), addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerUdpWriteQueueFull(t *testing.T) {
+	server := newTestServer(t, newFakeHierarchy(t), WithWorkers(1))
+	query, err := Encode(newQuery("www.example.com", TYPE_A), MessageSizeLimitUDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing writes the queued responses, the worker drops the ones that do not fit
+	responses := make(chan udpResponse, 1)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	for i := 0; i < 3; i++ {
+		server.handleUdpPacket(query, addr, &server.config.acl, responses)
+	}
+
+	// the single worker answers the queries in order, so they were all handled once this one is
+	done := make(chan struct{})
+	server.submitJob(workerJob{
+		message:   newQuery("www.example.com", TYPE_A),
+		responder: func(m *Message) { close(done) },
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker is blocked on the full write queue")
+	}
+	assert(t, len(responses), 1)
+}
+
+// answers from the cache with clients spread over one or several sockets. the sockets only
+// spread the packet i/o, every query still goes through the queue shared by the workers, so
+// more sockets are not expected to be faster unless packet i/o is the bottleneck.
+func BenchmarkServerUdp(b *testing.B) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer slog.SetDefault(logger)
+
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			server := newTestServer(b, newFakeHierarchy(b), WithWorkers(8), WithQueue(4096, OverloadServerFailure))
+			resolveTest(b, server.resolver, "www.example.com", TYPE_A)
+			addr := startUdpListener(b, server, listenerConfig{addr: "127.0.0.1:0", sockets: sockets})
+
+			query, err := Encode(newQuery("www.example.com", TYPE_A), MessageSizeLimitUDP)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				buf := make([]byte, MAX_UDP_MESSAGE_SIZE)
+				for pb.Next() {
+					conn.SetDeadline(time.Now().Add(time.Second))
+					if _, err := conn.Write(query); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.Read(buf); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -2,292 +2,231 @@ package dns
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
-	"net"
+	"net/netip"
+	"sync/atomic"
 )
 
-const defaultWorkerChannSize = 64
+const defaultWorkers = 8
+const defaultQueueSize = 512
 
-type workerJob struct {
-	message   *Message
-	responder func(*Message)
-}
+// OverloadAction is what the server does with a query that arrives while the queue is full.
+type OverloadAction uint8
 
-type worker struct {
-	ctx            context.Context
-	cancel         context.CancelFunc
-	chann          chan workerJob
-	authorityCache AuthorityCache
-	resourceCache  ResourceCache
-}
+const (
+	// answer with SERVFAIL so the client retries another server
+	OverloadServerFailure OverloadAction = iota
+	// answer with REFUSED
+	OverloadRefused
+	// drop the query without answering
+	OverloadDrop
+)
 
-func newWorker(authorityCache AuthorityCache, resourceCache ResourceCache) *worker {
-	chann := make(chan workerJob, defaultWorkerChannSize)
-	ctx, cancel := context.WithCancel(context.Background())
-	return &worker{
-		ctx:            ctx,
-		cancel:         cancel,
-		chann:          chann,
-		authorityCache: authorityCache,
-		resourceCache:  resourceCache,
+func (a OverloadAction) String() string {
+	switch a {
+	case OverloadServerFailure:
+		return "servfail"
+	case OverloadRefused:
+		return "refused"
+	case OverloadDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("OverloadAction(%d)", uint8(a))
 	}
 }
 
-func (w *worker) submit(job workerJob) {
-	w.chann <- job
+// SchedulerStats are the counters of the queue shared by the workers.
+type SchedulerStats struct {
+	Workers int
+	// queries waiting for a worker
+	QueueDepth    int
+	QueueCapacity int
+	// workers currently resolving a query
+	Busy int
+	// queries that were queued
+	Accepted uint64
+	// queries that were dropped or answered without resolution because the queue was full
+	Shed uint64
+	// prefetches that were not queued because the queue was too busy
+	PrefetchesSkipped uint64
 }
 
-func (w *worker) run() {
-	for {
-		select {
-		case <-w.ctx.Done():
-			return
-		case j := <-w.chann:
-			response := w.process(j)
-			j.responder(response)
-		}
-	}
+type workerJob struct {
+	message *Message
+	// called with the response, or with nil if the query is dropped without an answer
+	responder func(*Message)
+	// the address the query was received from, the zero value for internal queries
+	client netip.AddrPort
+	// answer only from the cache
+	cacheOnly bool
+	// refresh the cache for the question instead of answering it, responder is not used
+	prefetch bool
+	// called once the job is answered or shed, if set
+	done func()
 }
 
-func (w *worker) process(job workerJob) *Message {
-	slog.Info("processing job")
-	if debugLogEnabled() {
-		fmt.Println(job.message)
+func (j *workerJob) finish() {
+	if j.done != nil {
+		j.done()
 	}
+}
 
-	msg := job.message
-
-	if msg.Header.Response {
-		slog.Warn("received message with response flag set")
-		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR)
-	}
+// a bounded queue consumed by the workers. submitting never blocks, jobs that do not fit
+// in the queue are shed.
+type scheduler struct {
+	queue    chan workerJob
+	overload OverloadAction
 
-	if msg.Header.Opcode != OPCODE_QUERY {
-		slog.Warn("received message with opcode != OPCODE_QUERY", "opcode", msg.Header.Opcode)
-		return createErrorResponseMessage(msg, RCODE_NOT_IMPLEMENTED)
-	}
+	busy              atomic.Int64
+	accepted          atomic.Uint64
+	shed              atomic.Uint64
+	prefetchesSkipped atomic.Uint64
+}
 
-	if msg.Header.QuestionCount != 1 {
-		slog.Warn("received message with incorrect number of questions", "questions", msg.Header.QuestionCount)
-		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR)
+func newScheduler(size int, overload OverloadAction) *scheduler {
+	return &scheduler{
+		queue:    make(chan workerJob, size),
+		overload: overload,
 	}
+}
 
-	if msg.Header.AnswerCount != 0 || msg.Header.AuthoritativeCount != 0 || msg.Header.AdditionalCount != 0 {
-		slog.Warn("received message with resource records")
-		return createErrorResponseMessage(msg, RCODE_FORMAT_ERROR)
+// queue a query, if the queue is full the query is shed according to the overload action
+func (s *scheduler) submit(job workerJob) {
+	select {
+	case s.queue <- job:
+		s.accepted.Add(1)
+		return
+	default:
+	}
+
+	defer job.finish()
+	s.shed.Add(1)
+	slog.Debug("queue full, shedding query", "action", s.overload)
+	switch s.overload {
+	case OverloadDrop:
+		job.responder(nil)
+	case OverloadRefused:
+		job.responder(createErrorResponseMessage(job.message, RCODE_REFUSED))
+	default:
+		job.responder(createErrorResponseMessage(job.message, RCODE_SERVER_FAILURE))
 	}
+}
 
-	question := msg.Questions[0]
-
-	if question.Class != CLASS_IN {
-		slog.Warn("received message with question class != CLASS_IN", "class", question.Class)
-		return createErrorResponseMessage(msg, RCODE_NOT_IMPLEMENTED)
+// queue a prefetch only while the queue is at most half full, client queries take priority.
+// returns false if the prefetch was skipped.
+func (s *scheduler) submitPrefetch(name string, ty uint16) bool {
+	if len(s.queue) >= cap(s.queue)/2 {
+		s.prefetchesSkipped.Add(1)
+		return false
 	}
-
-	rrs := w.resolve(question.Name, question.Type, make(map[string]struct{}))
-	if rrs == nil {
-		return createErrorResponseMessage(msg, RCODE_SERVER_FAILURE)
+	select {
+	case s.queue <- workerJob{message: newQuery(name, ty), prefetch: true}:
+		return true
+	default:
+		s.prefetchesSkipped.Add(1)
+		return false
 	}
+}
 
-	response := &Message{}
-	response.Header.Id = msg.Header.Id
-	response.Header.Response = true
-	response.Header.RecursionAvailable = true
-	response.Header.RecursionDesired = msg.Header.RecursionDesired
-	response.Header.ResponseCode = RCODE_NO_ERROR
-	response.Header.QuestionCount = msg.Header.QuestionCount
-	response.Header.AnswerCount = uint16(len(rrs))
-	response.Questions = msg.Questions
-	response.Answers = rrs
-
-	if debugLogEnabled() {
-		fmt.Println("response")
-		fmt.Println(response)
+func (s *scheduler) stats() SchedulerStats {
+	return SchedulerStats{
+		QueueDepth:        len(s.queue),
+		QueueCapacity:     cap(s.queue),
+		Busy:              int(s.busy.Load()),
+		Accepted:          s.accepted.Load(),
+		Shed:              s.shed.Load(),
+		PrefetchesSkipped: s.prefetchesSkipped.Load(),
 	}
-
-	return response
 }
 
-// resolve the name following CNAMEs if necessary
-func (w *worker) resolve(name string, ty uint16, visitedCNAMEs map[string]struct{}) []RR {
-	if ip, ok := RootNameServersIpv4[name]; ok {
-		return []RR{{
-			RR_Header: RR_Header{
-				Name:  name,
-				Type:  ty,
-				Class: CLASS_IN,
-			},
-			Data: &RR_A{Addr: ip},
-		}}
-	}
+type worker struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	scheduler *scheduler
+	resolver  *Resolver
+	// closed to make the worker exit once the queue is empty
+	draining chan struct{}
+	// closed when the worker exits
+	done chan struct{}
+}
 
-	if rrs := w.resourceCache.Get(name, ty); rrs != nil {
-		return rrs
+func newWorker(scheduler *scheduler, resolver *Resolver) *worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &worker{
+		ctx:       ctx,
+		cancel:    cancel,
+		scheduler: scheduler,
+		resolver:  resolver,
+		draining:  make(chan struct{}),
+		done:      make(chan struct{}),
 	}
+}
 
-	// find the best nameservers and use the slice as a queue
-	nameservers := FindBestAuthorityServers(w.authorityCache, name)
-
-	resolveAnswer := make([]RR, 0)
+func (w *worker) run() {
+	defer close(w.done)
 	for {
-		if len(nameservers) == 0 {
-			break
-		}
-
-		nameserver := nameservers[len(nameservers)-1]
-		nameservers = nameservers[:len(nameservers)-1]
-		nameserverrrs := w.resolve(nameserver, TYPE_A, visitedCNAMEs)
-		nameserverips := extractIpsFromRRs(nameserverrrs)
-		if len(nameserverips) == 0 {
-			continue
-		}
-
-		sockaddrs := make([]sockAddr, len(nameserverips))
-		for idx, ip := range nameserverips {
-			sockaddrs[idx] = sockAddr{
-				Ip:   ip,
-				Port: 53,
-			}
-		}
-
-		resp, err := requestTcpAny(sockaddrs, name, ty)
-		if err != nil {
-			slog.Warn("failed to request", "error", err, "nameserver", nameserver)
-			continue
-		}
-
-		if len(resp.Answers) != 0 {
-			resolveAnswer = resp.Answers
-			break
-		}
-
-		zoneAuthoritiesMinTTL := uint32(math.MaxUint32)
-		zoneAuthorities := make(map[string][]string)
-		for _, rr := range resp.Authority {
-			if rr_ns, ok := rr.Data.(*RR_NS); ok {
-				zoneAuthorities[rr.Name] = append(zoneAuthorities[rr.Name], rr_ns.Nameserver)
-				zoneAuthoritiesMinTTL = min(zoneAuthoritiesMinTTL, rr.TTL)
-			}
-		}
-
-		for zone, zoneNameservers := range zoneAuthorities {
-			w.authorityCache.Put(zone, zoneNameservers, zoneAuthoritiesMinTTL)
-			for _, nameserver := range zoneNameservers {
-				nameservers = append(nameservers, nameserver)
-			}
-		}
-
-		for _, rr := range resp.Additional {
-			if rr.Type == TYPE_A || rr.Type == TYPE_AAAA {
-				w.resourceCache.Put(rr.Name, rr.Type, []RR{rr})
-			}
-		}
-	}
-
-	for _, rr := range resolveAnswer {
-		if rr.Type == TYPE_CNAME && ty != TYPE_CNAME {
-			cname := rr.Data.(*RR_CNAME)
-			if _, visited := visitedCNAMEs[cname.CNAME]; !visited {
-				visitedCNAMEs[cname.CNAME] = struct{}{}
-				cnamerrs := w.resolve(cname.CNAME, ty, visitedCNAMEs)
-				if cnamerrs == nil {
-					slog.Warn("failed to resolve cname", "cname", cname.CNAME)
-					return nil
-				}
-				for _, cnamerr := range cnamerrs {
-					resolveAnswer = append(resolveAnswer, cnamerr)
+		select {
+		case <-w.ctx.Done():
+			return
+		case j := <-w.scheduler.queue:
+			w.handle(j)
+		case <-w.draining:
+			// answer the jobs that were queued before the worker started draining
+			for {
+				select {
+				case <-w.ctx.Done():
+					return
+				case j := <-w.scheduler.queue:
+					w.handle(j)
+				default:
+					return
 				}
 			}
 		}
 	}
-
-	w.resourceCache.Put(name, ty, resolveAnswer)
-
-	return resolveAnswer
 }
 
-func requestTcpAny(addrs []sockAddr, name string, ty uint16) (*Message, error) {
-	lastErr := fmt.Errorf("no servers available")
-	for _, addr := range addrs {
-		slog.Debug("sending request", "address", addr)
-		if msg, err := requestTcp(addr, name, ty); err == nil {
-			slog.Debug("received response", "response", msg)
-			return msg, nil
-		} else {
-			lastErr = err
-			slog.Debug("failed to send request, trying next server", "address", addr, "error", err)
-		}
-	}
-	return nil, lastErr
+// stop the worker once the queued jobs are answered
+func (w *worker) drain() {
+	close(w.draining)
 }
 
-func requestTcp(addr sockAddr, name string, ty uint16) (*Message, error) {
-	conn, err := net.Dial("tcp", addr.String())
-	if err != nil {
-		slog.Debug("failed to dial dns server", "address", addr, "error", err)
-		return nil, err
-	}
+func (w *worker) handle(j workerJob) {
+	w.scheduler.busy.Add(1)
+	defer w.scheduler.busy.Add(-1)
+	defer j.finish()
 
-	msg := Message{}
-	msg.Header.Id = genRandomId()
-	msg.Header.Opcode = OPCODE_QUERY
-	msg.Header.QuestionCount = 1
-	msg.Questions = []Question{
-		{
-			Name:  name,
-			Type:  ty,
-			Class: CLASS_IN,
-		},
+	if j.prefetch {
+		question := j.message.Questions[0]
+		w.resolver.prefetch(w.ctx, question.Name, question.Type)
+		return
 	}
+	response := w.process(j)
+	j.responder(response)
+}
 
-	encodedRequest, err := Encode(&msg, MessageSizeLimitTCP)
-	if err != nil {
-		return nil, err
-	}
-
-	encodedLength := make([]byte, 2)
-	binary.BigEndian.PutUint16(encodedLength, uint16(len(encodedRequest)))
-	if _, err := conn.Write(encodedLength); err != nil {
-		slog.Debug("failed to write request length", "error", err)
-		return nil, err
-	}
-	if _, err := conn.Write(encodedRequest); err != nil {
-		slog.Debug("failed to write request", "error", err)
-		return nil, err
-	}
-
-	msgLen := make([]byte, 2)
-	if _, err := conn.Read(msgLen); err != nil {
-		slog.Debug("failed to read message length", "error", err)
-		return nil, err
-	}
-	mlen := binary.BigEndian.Uint16(msgLen)
-
-	buf := make([]byte, mlen)
-	_, err = conn.Read(buf)
-	if err != nil {
-		slog.Debug("failed to read response", "error", err)
-		return nil, err
+func (w *worker) process(job workerJob) *Message {
+	slog.Info("processing job")
+	if debugLogEnabled() {
+		fmt.Println(job.message)
 	}
 
-	resp, err := Decode(buf)
+	msg := job.message
+	response, err := w.resolver.exchange(w.ctx, msg, job.cacheOnly)
 	if err != nil {
-		slog.Debug("failed to decoded response", "error", err)
-		return nil, err
-	}
-
-	if resp.Header.Id != msg.Header.Id {
-		slog.Debug("received incorrect message id")
-		return nil, ErrIncorrectIdReceived
+		if errors.Is(err, ErrRecursionLimitExceeded) {
+			question := msg.Questions[0]
+			slog.Warn("recursion limit exceeded", "name", question.Name, "type", typeToString(question.Type), "error", err)
+		}
+		return createErrorResponseMessage(msg, RCODE_SERVER_FAILURE)
 	}
 
 	if debugLogEnabled() {
-		fmt.Println("server response")
-		fmt.Println(resp)
+		fmt.Println("response")
+		fmt.Println(response)
 	}
 
-	return resp, nil
+	return response
 }
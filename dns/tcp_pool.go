@@ -0,0 +1,299 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ Transport = (*TcpPool)(nil)
+
+const defaultPoolIdleTimeout = 10 * time.Second
+const defaultPoolQueryTimeout = 5 * time.Second
+const defaultPoolMaxPipelined = 32
+
+var ErrConnectionClosed = fmt.Errorf("connection closed")
+
+// TcpPool is a Transport that keeps tcp connections to upstream servers open and pipelines
+// queries on them, matching responses to queries by id (RFC 7766 section 6.2.1).
+// if TLSConfig is set the connections use dns over tls (RFC 7858).
+// the zero value is ready to use. it is safe for concurrent use.
+type TcpPool struct {
+	// how long a connection without outstanding queries is kept open, defaults to 10 seconds
+	IdleTimeout time.Duration
+	// how long to wait for the response to a query, defaults to 5 seconds
+	QueryTimeout time.Duration
+	// maximum number of outstanding queries on a single connection before opening another, defaults to 32
+	MaxPipelined int
+	Dialer       net.Dialer
+	// wrap the connections in tls with this configuration, plain tcp is used if nil
+	TLSConfig *tls.Config
+
+	mu     sync.Mutex
+	conns  map[string][]*pooledConn
+	closed bool
+}
+
+type pooledResult struct {
+	msg *Message
+	err error
+}
+
+type pooledQuery struct {
+	query  *Message
+	result chan pooledResult
+}
+
+// a connection shared by concurrent queries to the same upstream
+type pooledConn struct {
+	pool *TcpPool
+	addr string
+	conn net.Conn
+	// serializes writes so pipelined messages are not interleaved
+	writeMu sync.Mutex
+
+	// protected by pool.mu
+	pending map[uint16]pooledQuery
+	closed  bool
+	idle    *time.Timer
+}
+
+// Exchange implements Transport.
+// if the connection is closed by the server before the response arrives the query is retried once on a new connection.
+func (p *TcpPool) Exchange(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var pc *pooledConn
+		pc, err = p.get(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp *Message
+		resp, err = pc.exchange(ctx, msg, p.queryTimeout())
+		if !errors.Is(err, ErrConnectionClosed) || ctx.Err() != nil {
+			return resp, err
+		}
+		slog.Debug("pooled connection closed while waiting for a response, retrying", "address", addr)
+	}
+	return nil, err
+}
+
+// close every pooled connection, outstanding queries fail with ErrConnectionClosed
+func (p *TcpPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	conns := make([]*pooledConn, 0)
+	for _, addrConns := range p.conns {
+		conns = append(conns, addrConns...)
+	}
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.close(ErrConnectionClosed)
+	}
+	return nil
+}
+
+func (p *TcpPool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return defaultPoolIdleTimeout
+}
+
+func (p *TcpPool) queryTimeout() time.Duration {
+	if p.QueryTimeout > 0 {
+		return p.QueryTimeout
+	}
+	return defaultPoolQueryTimeout
+}
+
+func (p *TcpPool) maxPipelined() int {
+	if p.MaxPipelined > 0 {
+		return p.MaxPipelined
+	}
+	return defaultPoolMaxPipelined
+}
+
+// a connection to addr with room for another query, dialing a new one if necessary
+func (p *TcpPool) get(ctx context.Context, addr string) (*pooledConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	for _, pc := range p.conns[addr] {
+		if !pc.closed && len(pc.pending) < p.maxPipelined() {
+			p.mu.Unlock()
+			return pc, nil
+		}
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial(ctx, addr)
+	if err != nil {
+		slog.Debug("failed to dial dns server", "address", addr, "error", err)
+		return nil, err
+	}
+
+	pc := &pooledConn{
+		pool:    p,
+		addr:    addr,
+		conn:    conn,
+		pending: make(map[uint16]pooledQuery),
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return nil, ErrConnectionClosed
+	}
+	if p.conns == nil {
+		p.conns = make(map[string][]*pooledConn)
+	}
+	p.conns[addr] = append(p.conns[addr], pc)
+	pc.idle = time.AfterFunc(p.idleTimeout(), pc.closeIfIdle)
+	p.mu.Unlock()
+
+	go pc.readLoop()
+	return pc, nil
+}
+
+func (p *TcpPool) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if p.TLSConfig == nil {
+		return p.Dialer.DialContext(ctx, "tcp", addr)
+	}
+	dialer := &tls.Dialer{NetDialer: &p.Dialer, Config: p.TLSConfig}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// send the query and wait for its response. the query is sent with an id that is unique on
+// the connection, the response is returned with the id of msg.
+func (pc *pooledConn) exchange(ctx context.Context, msg *Message, timeout time.Duration) (*Message, error) {
+	query := *msg
+	result := make(chan pooledResult, 1)
+
+	pc.pool.mu.Lock()
+	if pc.closed {
+		pc.pool.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	query.Header.Id = genRandomId()
+	for _, taken := pc.pending[query.Header.Id]; taken; _, taken = pc.pending[query.Header.Id] {
+		query.Header.Id = genRandomId()
+	}
+	pc.pending[query.Header.Id] = pooledQuery{query: &query, result: result}
+	pc.idle.Stop()
+	pc.pool.mu.Unlock()
+	defer pc.forget(query.Header.Id)
+
+	pc.writeMu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := writeTcpMessage(pc.conn, &query)
+	pc.writeMu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+		pc.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-result:
+		if res.err != nil {
+			return nil, res.err
+		}
+		resp := *res.msg
+		resp.Header.Id = msg.Header.Id
+		return &resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for response from %v", pc.addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// remove a query that is no longer waiting for a response
+func (pc *pooledConn) forget(id uint16) {
+	pc.pool.mu.Lock()
+	defer pc.pool.mu.Unlock()
+	delete(pc.pending, id)
+	if len(pc.pending) == 0 && !pc.closed {
+		pc.idle.Reset(pc.pool.idleTimeout())
+	}
+}
+
+// deliver responses to the queries waiting for them until the connection fails or is closed
+func (pc *pooledConn) readLoop() {
+	for {
+		resp, err := readTcpMessage(pc.conn)
+		if err != nil {
+			pc.close(fmt.Errorf("%w: %v", ErrConnectionClosed, err))
+			return
+		}
+
+		pc.pool.mu.Lock()
+		pending, ok := pc.pending[resp.Header.Id]
+		if ok {
+			delete(pc.pending, resp.Header.Id)
+		}
+		pc.pool.mu.Unlock()
+
+		if !ok {
+			slog.Debug("received response for unknown query", "address", pc.addr, "id", resp.Header.Id)
+			continue
+		}
+		if err := validateResponse(pending.query, resp); err != nil {
+			pending.result <- pooledResult{err: err}
+			continue
+		}
+		pending.result <- pooledResult{msg: resp}
+	}
+}
+
+func (pc *pooledConn) closeIfIdle() {
+	pc.pool.mu.Lock()
+	idle := len(pc.pending) == 0
+	pc.pool.mu.Unlock()
+	if idle {
+		slog.Debug("closing idle connection", "address", pc.addr)
+		pc.close(ErrConnectionClosed)
+	}
+}
+
+// close the connection, remove it from the pool and fail the outstanding queries with err
+func (pc *pooledConn) close(err error) {
+	pc.pool.mu.Lock()
+	if pc.closed {
+		pc.pool.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	pc.idle.Stop()
+	conns := pc.pool.conns[pc.addr]
+	for i, other := range conns {
+		if other == pc {
+			pc.pool.conns[pc.addr] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(pc.pool.conns[pc.addr]) == 0 {
+		delete(pc.pool.conns, pc.addr)
+	}
+	pending := pc.pending
+	pc.pending = make(map[uint16]pooledQuery)
+	pc.pool.mu.Unlock()
+
+	pc.conn.Close()
+	for _, query := range pending {
+		query.result <- pooledResult{err: err}
+	}
+}
@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTcpPoolPipelining(t *testing.T) {
+	_, listener := listenLocal(t)
+
+	accepted := make(chan struct{}, 8)
+	received := make(chan struct{}, 8)
+	closed := make(chan struct{}, 8)
+	go func() {
+		first := true
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+
+			// the first connection is closed by the server after reading a query
+			if first {
+				first = false
+				readTcpMessage(conn)
+				conn.Close()
+				continue
+			}
+
+			go func(conn net.Conn) {
+				defer func() { closed <- struct{}{} }()
+				defer conn.Close()
+				// answer pairs of queries in reverse order
+				for {
+					q1, err := readTcpMessage(conn)
+					if err != nil {
+						return
+					}
+					received <- struct{}{}
+					q2, err := readTcpMessage(conn)
+					if err != nil {
+						return
+					}
+					writeTcpMessage(conn, testAnswer(q2, false))
+					writeTcpMessage(conn, testAnswer(q1, false))
+				}
+			}(conn)
+		}
+	}()
+
+	pool := &TcpPool{IdleTimeout: 100 * time.Millisecond, QueryTimeout: 5 * time.Second}
+	defer pool.Close()
+	ctx := context.Background()
+
+	// the first query is retried on a new connection after the server closes the first one,
+	// the second is pipelined on the same connection once the first was received
+	var wg sync.WaitGroup
+	names := []string{"a.example.com", "b.example.com"}
+	for i, name := range names {
+		if i > 0 {
+			<-received
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			query := newQuery(name, TYPE_A)
+			resp, err := pool.Exchange(ctx, query, listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert(t, resp.Header.Id, query.Header.Id)
+			assert(t, resp.Answers[0].Name, name)
+		}(name)
+	}
+	wg.Wait()
+	assert(t, len(accepted), 2)
+
+	// the idle connection is closed
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
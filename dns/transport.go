@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+var _ Transport = (*TcpTransport)(nil)
+
+// delay between starting connection attempts to different addresses, as recommended by RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// Transport sends a query to an upstream server and waits for its response.
+// all upstream traffic of the resolver goes through a Transport, which allows
+// replacing the network in tests.
+type Transport interface {
+	// send msg to the server at addr, in host:port form, and return its response
+	Exchange(ctx context.Context, msg *Message, addr string) (*Message, error)
+}
+
+// TcpTransport sends every query over a new tcp connection.
+type TcpTransport struct {
+	Dialer net.Dialer
+}
+
+// Exchange implements Transport.
+func (t *TcpTransport) Exchange(ctx context.Context, msg *Message, addr string) (*Message, error) {
+	conn, err := t.Dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		slog.Debug("failed to dial dns server", "address", addr, "error", err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	// unblock reads and writes if the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := writeTcpMessage(conn, msg); err != nil {
+		slog.Debug("failed to write request", "error", err)
+		return nil, err
+	}
+	return readTcpMessage(conn)
+}
+
+// write msg prefixed with its two byte length (RFC 1035 section 4.2.2)
+func writeTcpMessage(w io.Writer, msg *Message) error {
+	encoded, err := Encode(msg, MessageSizeLimitTCP)
+	if err != nil {
+		return err
+	}
+	return writeTcpFrame(w, encoded)
+}
+
+// read a message prefixed with its two byte length
+func readTcpMessage(r io.Reader) (*Message, error) {
+	frame, err := readTcpFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := Decode(frame)
+	if err != nil {
+		slog.Debug("failed to decode message", "error", err)
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTcpFrame(w io.Writer, encoded []byte) error {
+	framed := make([]byte, 2, 2+len(encoded))
+	binary.BigEndian.PutUint16(framed, uint16(len(encoded)))
+	_, err := w.Write(append(framed, encoded...))
+	return err
+}
+
+func readTcpFrame(r io.Reader) ([]byte, error) {
+	frameLen := make([]byte, 2)
+	if _, err := io.ReadFull(r, frameLen); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint16(frameLen))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func newQuery(name string, ty uint16) *Message {
+	msg := &Message{}
+	msg.Header.Id = genRandomId()
+	msg.Header.Opcode = OPCODE_QUERY
+	msg.Header.QuestionCount = 1
+	msg.Questions = []Question{
+		{
+			Name:  name,
+			Type:  ty,
+			Class: CLASS_IN,
+		},
+	}
+	return msg
+}
+
+// check that resp is a response to query
+func validateResponse(query *Message, resp *Message) error {
+	if resp.Header.Id != query.Header.Id {
+		return ErrIncorrectIdReceived
+	}
+	// some servers omit the question section in error responses
+	if len(resp.Questions) == 0 {
+		return nil
+	}
+	if len(resp.Questions) != 1 {
+		return ErrUnexpectedQuestion
+	}
+	q, r := query.Questions[0], resp.Questions[0]
+	if !nameEq(q.Name, r.Name) || q.Type != r.Type || q.Class != r.Class {
+		return ErrUnexpectedQuestion
+	}
+	return nil
+}
+
+// send a single query for name and ty to addr using transport
+func request(ctx context.Context, transport Transport, addr sockAddr, name string, ty uint16) (*Message, error) {
+	query := newQuery(name, ty)
+	resp, err := transport.Exchange(ctx, query, addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateResponse(query, resp); err != nil {
+		slog.Debug("received invalid response", "address", addr, "error", err)
+		return nil, err
+	}
+
+	if debugLogEnabled() {
+		fmt.Println("server response")
+		fmt.Println(resp)
+	}
+
+	return resp, nil
+}
+
+// order the addresses so that the address families alternate, starting with IPv6 (RFC 8305 section 4)
+func interleaveAddressFamilies(addrs []sockAddr) []sockAddr {
+	ipv4 := make([]sockAddr, 0)
+	ipv6 := make([]sockAddr, 0)
+	for _, addr := range addrs {
+		if addr.IsIpv4() {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	interleaved := make([]sockAddr, 0, len(addrs))
+	for i := 0; i < max(len(ipv4), len(ipv6)); i++ {
+		if i < len(ipv6) {
+			interleaved = append(interleaved, ipv6[i])
+		}
+		if i < len(ipv4) {
+			interleaved = append(interleaved, ipv4[i])
+		}
+	}
+	return interleaved
+}
+
+type requestResult struct {
+	msg  *Message
+	addr sockAddr
+	err  error
+}
+
+// send the request to the given addresses using transport, happy eyeballs style.
+// a new attempt is started every connectionAttemptDelay or as soon as the previous one fails,
+// the first successful response is returned and the remaining attempts are cancelled.
+func requestAny(ctx context.Context, transport Transport, addrs []sockAddr, name string, ty uint16) (*Message, error) {
+	addrs = interleaveAddressFamilies(addrs)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no servers available")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan requestResult, len(addrs))
+	attempt := func(addr sockAddr) {
+		slog.Debug("sending request", "address", addr)
+		msg, err := request(ctx, transport, addr, name, ty)
+		results <- requestResult{msg: msg, addr: addr, err: err}
+	}
+
+	next := 0
+	pending := 0
+	var lastErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for next < len(addrs) || pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next += 1
+				pending += 1
+				timer.Reset(connectionAttemptDelay)
+			}
+		case result := <-results:
+			pending -= 1
+			if result.err == nil {
+				slog.Debug("received response", "response", result.msg, "address", result.addr)
+				return result.msg, nil
+			}
+			lastErr = result.err
+			slog.Debug("failed to send request, trying next server", "address", result.addr, "error", result.err)
+			if next < len(addrs) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
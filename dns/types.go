@@ -3,6 +3,7 @@ package dns
 import (
 	"fmt"
 	"net"
+	"strconv"
 )
 
 var ErrInsufficientData = fmt.Errorf("insufficient data while decoding message")
@@ -14,6 +15,9 @@ var ErrInvalidRRType = fmt.Errorf("invalid RR type")
 var ErrInvalidRRData = fmt.Errorf("invalid RR data")
 var ErrNotImplemented = fmt.Errorf("not implemented")
 var ErrIncorrectIdReceived = fmt.Errorf("received incorrect message id in response")
+var ErrNoResponse = fmt.Errorf("no nameserver responded")
+var ErrZoneUnreachable = fmt.Errorf("no nameserver of the zone answered")
+var ErrUnexpectedQuestion = fmt.Errorf("response question does not match the request")
 
 const MAX_LABEL_SIZE = 63
 const MAX_UDP_MESSAGE_SIZE = 512
@@ -62,6 +66,7 @@ const (
 	TYPE_MAILB
 	TYPE_MAILA
 	TYPE_AAAA = 28
+	TYPE_OPT  = 41
 	TYPE_ANY  = 255
 )
 
@@ -86,6 +91,7 @@ var TypeString map[uint16]string = map[uint16]string{
 	TYPE_MAILA: "MAILA",
 	TYPE_NS:    "NS",
 	TYPE_AAAA:  "AAAA",
+	TYPE_OPT:   "OPT",
 }
 
 const (
@@ -113,7 +119,70 @@ type sockAddr struct {
 }
 
 func (addr *sockAddr) String() string {
-	return fmt.Sprintf("[%v]:%v", addr.Ip, addr.Port)
+	return net.JoinHostPort(addr.Ip.String(), strconv.Itoa(int(addr.Port)))
+}
+
+func (addr *sockAddr) IsIpv4() bool {
+	return addr.Ip.To4() != nil
+}
+
+// AddressFamily selects which IP versions are used to reach authoritative servers.
+type AddressFamily uint8
+
+const (
+	// Use both IPv4 and IPv6, racing connection attempts between them.
+	AddressFamilyAny AddressFamily = iota
+	AddressFamilyIpv4
+	AddressFamilyIpv6
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AddressFamilyAny:
+		return "any"
+	case AddressFamilyIpv4:
+		return "ipv4"
+	case AddressFamilyIpv6:
+		return "ipv6"
+	default:
+		return strconv.FormatInt(int64(f), 10)
+	}
+}
+
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch s {
+	case "any", "":
+		return AddressFamilyAny, nil
+	case "ipv4", "4":
+		return AddressFamilyIpv4, nil
+	case "ipv6", "6":
+		return AddressFamilyIpv6, nil
+	default:
+		return AddressFamilyAny, fmt.Errorf("invalid address family: %v", s)
+	}
+}
+
+// the address record types that should be looked up for nameservers
+func (f AddressFamily) recordTypes() []uint16 {
+	switch f {
+	case AddressFamilyIpv4:
+		return []uint16{TYPE_A}
+	case AddressFamilyIpv6:
+		return []uint16{TYPE_AAAA}
+	default:
+		return []uint16{TYPE_AAAA, TYPE_A}
+	}
+}
+
+func (f AddressFamily) allows(addr sockAddr) bool {
+	switch f {
+	case AddressFamilyIpv4:
+		return addr.IsIpv4()
+	case AddressFamilyIpv6:
+		return !addr.IsIpv4()
+	default:
+		return true
+	}
 }
 
 type Header struct {
@@ -204,7 +273,9 @@ type RR_Unknown struct {
 
 // writeData implements RRData.
 func (r *RR_Unknown) writeData(buf *dnsBuffer) error {
-	buf.WriteU16(uint16(len(r.Data)))
+	if len(r.Data) > 65535 {
+		return ErrRDataToLarge
+	}
 	buf.Write(r.Data)
 	return nil
 }
@@ -222,7 +293,7 @@ type RR_A struct {
 
 // String implements RRData.
 func (rr *RR_A) String() string {
-	return fmt.Sprintf("%v.%v.%v.%v", rr.Addr[3], rr.Addr[2], rr.Addr[1], rr.Addr[0])
+	return fmt.Sprintf("%v.%v.%v.%v", rr.Addr[0], rr.Addr[1], rr.Addr[2], rr.Addr[3])
 }
 
 // writeData implements RRData.
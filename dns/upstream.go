@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrPinMismatch = fmt.Errorf("no certificate matches the pinned public keys")
+
+// UpstreamConfig configures the connection to a recursive server queries are forwarded to.
+type UpstreamConfig struct {
+	// tcp://host[:53], tls://host[:853] or https://host[:443]/path.
+	// a host:port without a scheme uses plain tcp.
+	URL string
+	// name used for SNI and to verify the certificate, defaults to the host of the url
+	ServerName string
+	// certificate authorities trusted for this upstream, the system pool is used if both are empty
+	RootCAs *x509.CertPool
+	// path of a pem file with certificate authorities trusted for this upstream
+	CAFile string
+	// base64 sha256 digests of the subject public key info (RFC 7469 pin-sha256), at least
+	// one certificate of the verified chain must match one of them if any are given
+	SPKIPins []string
+	// how long to wait for a response, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+// Upstream is a recursive server queries can be forwarded to.
+type Upstream struct {
+	url       string
+	addr      string
+	transport Transport
+}
+
+func NewUpstream(config UpstreamConfig) (*Upstream, error) {
+	rawURL := config.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "tcp://" + rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream url %q", config.URL)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultPoolQueryTimeout
+	}
+
+	switch parsed.Scheme {
+	case "tcp":
+		return &Upstream{
+			url:       config.URL,
+			addr:      hostPort(parsed, "53"),
+			transport: &TcpPool{QueryTimeout: timeout},
+		}, nil
+	case "tls":
+		tlsConfig, err := config.tlsConfig(parsed.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return &Upstream{
+			url:       config.URL,
+			addr:      hostPort(parsed, "853"),
+			transport: &TcpPool{QueryTimeout: timeout, TLSConfig: tlsConfig},
+		}, nil
+	case "https":
+		tlsConfig, err := config.tlsConfig(parsed.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   defaultPoolIdleTimeout,
+			},
+		}
+		return &Upstream{
+			url:       config.URL,
+			addr:      parsed.String(),
+			transport: &HttpsTransport{Client: client},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid upstream url %q: unsupported scheme %q", config.URL, parsed.Scheme)
+	}
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (c *UpstreamConfig) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		RootCAs:            c.RootCAs,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream ca file: %w", err)
+		}
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream ca file %v", c.CAFile)
+		}
+	}
+
+	if len(c.SPKIPins) != 0 {
+		pins := make([][]byte, 0, len(c.SPKIPins))
+		for _, pin := range c.SPKIPins {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %q", pin)
+			}
+			pins = append(pins, digest)
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySPKIPins(state, pins)
+		}
+	}
+	return config, nil
+}
+
+// check that a certificate of the verified chains matches one of the pins.
+// resumed sessions were verified when they were established.
+func verifySPKIPins(state tls.ConnectionState, pins [][]byte) error {
+	if state.DidResume {
+		return nil
+	}
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// the pin-sha256 of a certificate, as used in UpstreamConfig.SPKIPins
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// send msg to the upstream and return its response
+func (u *Upstream) Exchange(ctx context.Context, msg *Message) (*Message, error) {
+	return u.transport.Exchange(ctx, msg, u.addr)
+}
+
+// close the connections kept open to the upstream
+func (u *Upstream) Close() error {
+	if closer, ok := u.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	if transport, ok := u.transport.(*HttpsTransport); ok {
+		transport.Client.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (u *Upstream) String() string {
+	return u.url
+}
@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestUpstreams(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t, t.TempDir(), 1)
+	server := newTestServer(t, newFakeHierarchy(t),
+		WithTlsListener("127.0.0.1:0", certFile, keyFile),
+		WithHttpsListener("127.0.0.1:0", certFile, keyFile))
+
+	tlsListener, err := server.listenTls(server.config.tlsListeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsListener.Close()
+	go server.receiverTcp(tlsListener, &server.config.acl)
+
+	httpsListener, httpServer, err := server.listenHttps(server.config.httpsListeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go httpServer.ServeTLS(httpsListener, "", "")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tlsURL := "tls://" + tlsListener.Addr().String()
+	httpsURL := "https://" + httpsListener.Addr().String() + dohPath
+
+	exchange := func(config UpstreamConfig) (*Message, error) {
+		upstream, err := NewUpstream(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upstream.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		query := newQuery("www.example.com", TYPE_A)
+		query.Header.RecursionDesired = true
+		resp, err := upstream.Exchange(ctx, query)
+		if err == nil {
+			assert(t, resp.Header.Id, query.Header.Id)
+		}
+		return resp, err
+	}
+
+	for _, url := range []string{tlsURL, httpsURL} {
+		resp, err := exchange(UpstreamConfig{URL: url, RootCAs: roots})
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		assertAnswers(t, resp, "www.example.com A 10.0.1.1")
+
+		// the certificate must match the server name
+		_, err = exchange(UpstreamConfig{URL: url, RootCAs: roots, ServerName: "dns.example"})
+		assert(t, err != nil, true, url)
+
+		// the public key must match one of the pins
+		_, err = exchange(UpstreamConfig{URL: url, RootCAs: roots, SPKIPins: []string{SPKIPin(cert)}})
+		assert(t, err, nil, url)
+		_, err = exchange(UpstreamConfig{URL: url, RootCAs: roots, SPKIPins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}})
+		assert(t, err != nil, true, url)
+	}
+
+	for _, url := range []string{"ftp://127.0.0.1", "tls://", "https://[::1"} {
+		_, err := NewUpstream(UpstreamConfig{URL: url})
+		assert(t, err != nil, true, url)
+	}
+	_, err = NewUpstream(UpstreamConfig{URL: tlsURL, SPKIPins: []string{"not a pin"}})
+	assert(t, err != nil, true)
+}
+
+func TestResolverForwarders(t *testing.T) {
+	network := newFakeHierarchy(t)
+	r := newTestResolver(t, network, ResolverConfig{
+		Forwarders: []*Upstream{
+			{url: "tcp://10.9.9.9", addr: "10.9.9.9:53", transport: network},
+			{url: "tcp://10.0.0.1", addr: "10.0.0.1:53", transport: network},
+		},
+	})
+
+	// the unreachable forwarder is skipped and the root is never queried
+	res := resolveTest(t, r, "www.example.com", TYPE_A)
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	assert(t, network.queriesTo("10.9.9.9"), 1)
+	assert(t, network.queriesTo("10.0.0.1"), 1)
+	assert(t, network.queriesTo("198.41.0.4"), 0)
+
+	// answers are cached
+	res = resolveTest(t, r, "www.example.com", TYPE_A)
+	assertAnswers(t, res, "www.example.com A 10.0.1.1")
+	assert(t, network.queriesTo("10.0.0.1"), 1)
+
+	res = resolveTest(t, r, "missing.example.com", TYPE_A)
+	assert(t, res.Header.ResponseCode, RCODE_NAME_ERROR)
+	assert(t, len(res.Authority), 1)
+
+	// every forwarder failing is an error
+	network.server("10.0.0.1").down = true
+	_, err := r.Resolve(context.Background(), "mail.example.com", TYPE_A, CLASS_IN)
+	assert(t, err, ErrNoResponse)
+}
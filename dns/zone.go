@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const defaultZoneTTL = 3600
+
+// parse resource records in the master file format described in RFC 1035 section 5.1.
+// only a subset of the format is supported: one record per line (no parentheses), the
+// $ORIGIN and $TTL directives and the record types listed in parseZoneRData.
+// names are returned in lowercase and without the trailing dot.
+func parseZone(r io.Reader, origin string) ([]RR, error) {
+	rrs := make([]RR, 0)
+	origin = strings.ToLower(strings.TrimSuffix(origin, "."))
+	ttl := uint32(defaultZoneTTL)
+	owner := ""
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno += 1
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, ';'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %v: invalid $ORIGIN directive", lineno)
+			}
+			origin = zoneName(fields[1], origin)
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %v: invalid $TTL directive", lineno)
+			}
+			v, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid $TTL directive: %w", lineno, err)
+			}
+			ttl = uint32(v)
+			continue
+		}
+
+		// a line starting with whitespace reuses the previous owner
+		if line[0] != ' ' && line[0] != '\t' {
+			owner = zoneName(fields[0], origin)
+			fields = fields[1:]
+		}
+
+		header := RR_Header{Name: owner, Class: CLASS_IN, TTL: ttl}
+		for len(fields) > 0 {
+			if v, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				header.TTL = uint32(v)
+			} else if class, ok := parseClass(fields[0]); ok {
+				header.Class = class
+			} else {
+				break
+			}
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %v: missing record type", lineno)
+		}
+
+		ty, ok := parseType(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("line %v: unknown record type '%v'", lineno, fields[0])
+		}
+		header.Type = ty
+
+		data, err := parseZoneRData(ty, fields[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineno, err)
+		}
+		rrs = append(rrs, RR{RR_Header: header, Data: data})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rrs, nil
+}
+
+func parseZoneRData(ty uint16, fields []string, origin string) (RRData, error) {
+	expect := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("%v record expects %v fields, got %v", typeToString(ty), n, len(fields))
+		}
+		return nil
+	}
+
+	switch ty {
+	case TYPE_A:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ipv4 address '%v'", fields[0])
+		}
+		return &RR_A{Addr: [4]byte(ip)}, nil
+	case TYPE_AAAA:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 address '%v'", fields[0])
+		}
+		return &RR_AAAA{Addr: [16]byte(ip.To16())}, nil
+	case TYPE_NS:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		return &RR_NS{Nameserver: zoneName(fields[0], origin)}, nil
+	case TYPE_CNAME:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		return &RR_CNAME{CNAME: zoneName(fields[0], origin)}, nil
+	case TYPE_PTR:
+		if err := expect(1); err != nil {
+			return nil, err
+		}
+		return &RR_PTR{PTRDNAME: zoneName(fields[0], origin)}, nil
+	case TYPE_MX:
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mx preference '%v'", fields[0])
+		}
+		return &RR_MX{Preference: uint16(preference), Exchange: zoneName(fields[1], origin)}, nil
+	case TYPE_SOA:
+		if err := expect(7); err != nil {
+			return nil, err
+		}
+		values := make([]uint32, 5)
+		for i, field := range fields[2:] {
+			v, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid soa field '%v'", field)
+			}
+			values[i] = uint32(v)
+		}
+		return &RR_SOA{
+			MNAME:   zoneName(fields[0], origin),
+			RNAME:   zoneName(fields[1], origin),
+			SERIAL:  values[0],
+			REFRESH: values[1],
+			RETRY:   values[2],
+			EXPIRE:  values[3],
+			MINIMUM: values[4],
+		}, nil
+	case TYPE_TXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("TXT record expects at least 1 field")
+		}
+		// only a single character string is supported, quotes are stripped
+		return &RR_TXT{Data: strings.Trim(strings.Join(fields, " "), "\"")}, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %v", typeToString(ty))
+	}
+}
+
+// convert a name in a zone file to the representation used by the decoder
+func zoneName(name string, origin string) string {
+	name = strings.ToLower(name)
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin == "" {
+		return name
+	}
+	return name + "." + origin
+}
+
+func parseType(s string) (uint16, bool) {
+	for ty, name := range TypeString {
+		if strings.EqualFold(name, s) {
+			return ty, true
+		}
+	}
+	return 0, false
+}
+
+func parseClass(s string) (uint16, bool) {
+	for class, name := range ClassString {
+		if strings.EqualFold(name, s) {
+			return class, true
+		}
+	}
+	return 0, false
+}
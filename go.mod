@@ -1,3 +1,8 @@
 module git.d464.sh/diogo464/dns-server
 
 go 1.22.1
+
+require (
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+)
@@ -1,15 +1,38 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"git.d464.sh/diogo464/dns-server/dns"
 )
 
 var FlagDebug = flag.Bool("debug", false, "enable debug logs")
 var FlagAddress = flag.String("port", "0.0.0.0:2053", "udp listen address")
+var FlagRootHints = flag.String("root-hints", "", "path to a named.root hints file, the built-in hints are used if empty or absent")
+var FlagServeStale = flag.Duration("serve-stale", 0, "serve expired records for this long when nameservers are unreachable, disabled if zero")
+var FlagServeStaleTimeout = flag.Duration("serve-stale-timeout", 1800*time.Millisecond, "answer with expired records when resolution takes longer than this, if serve-stale is enabled")
+var FlagPrefetch = flag.Int("prefetch", 0, "refresh records hit at least this many times before they expire, disabled if zero")
+var FlagCacheSnapshot = flag.String("cache-snapshot", "", "path of the file the caches are persisted to, disabled if empty")
+var FlagFamily = flag.String("family", "any", "address family used to contact nameservers (any, ipv4, ipv6)")
+var FlagTlsAddress = flag.String("tls", "", "dns over tls listen address, disabled if empty")
+var FlagHttpsAddress = flag.String("https", "", "dns over https listen address, disabled if empty")
+var FlagTlsCert = flag.String("tls-cert", "", "path of the tls certificate used for tls and https, reloaded when it changes")
+var FlagTlsKey = flag.String("tls-key", "", "path of the tls private key used for tls and https, reloaded when it changes")
+var FlagForward = flag.String("forward", "", "comma separated upstream urls (tcp://, tls://, https://) to forward queries to instead of recursing")
+var FlagForwardCA = flag.String("forward-ca", "", "path of a pem file with the certificate authorities trusted for the upstreams, the system pool is used if empty")
+var FlagAllow = flag.String("allow", "", "comma separated networks allowed to use recursion in addition to loopback and private networks")
+var FlagRateLimit = flag.Int("rrl", 0, "limit udp responses to each client network to this many per second, disabled if zero")
+var FlagRateLimitLogOnly = flag.Bool("rrl-log-only", false, "log the responses that would be rate limited without limiting them")
+var FlagClientQps = flag.Int("client-qps", 0, "limit the queries of each client address to this many per second, disabled if zero")
+var FlagUdpSockets = flag.Int("udp-sockets", 1, "number of udp sockets bound to the listen address with SO_REUSEPORT")
+var FlagShutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "how long to wait for in-flight queries when shutting down")
 
 func main() {
 	flag.Parse()
@@ -18,12 +41,82 @@ func main() {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
 
-	server, err := dns.NewServer(dns.WithUdpListener(*FlagAddress))
+	family, err := dns.ParseAddressFamily(*FlagFamily)
+	if err != nil {
+		slog.Error("invalid address family", "error", err)
+		os.Exit(1)
+	}
+
+	acl := dns.DefaultAcl()
+	if *FlagAllow != "" {
+		acl, err = acl.With(dns.AclAllow, strings.Split(*FlagAllow, ",")...)
+		if err != nil {
+			slog.Error("invalid allowed networks", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	opts := []dns.ServerOption{
+		dns.WithAcl(acl),
+		dns.WithUdpListener(*FlagAddress, dns.WithSockets(*FlagUdpSockets)),
+		dns.WithAddressFamily(family),
+	}
+	if *FlagServeStale > 0 {
+		opts = append(opts, dns.WithServeStale(*FlagServeStale, *FlagServeStaleTimeout))
+	}
+	if *FlagPrefetch > 0 {
+		opts = append(opts, dns.WithPrefetch(*FlagPrefetch))
+	}
+	if *FlagCacheSnapshot != "" {
+		opts = append(opts, dns.WithCacheSnapshot(*FlagCacheSnapshot, 5*time.Minute))
+	}
+	if *FlagTlsAddress != "" {
+		opts = append(opts, dns.WithTlsListener(*FlagTlsAddress, *FlagTlsCert, *FlagTlsKey))
+	}
+	if *FlagHttpsAddress != "" {
+		opts = append(opts, dns.WithHttpsListener(*FlagHttpsAddress, *FlagTlsCert, *FlagTlsKey))
+	}
+	if *FlagForward != "" {
+		upstreams := make([]dns.UpstreamConfig, 0)
+		for _, url := range strings.Split(*FlagForward, ",") {
+			upstreams = append(upstreams, dns.UpstreamConfig{URL: strings.TrimSpace(url), CAFile: *FlagForwardCA})
+		}
+		opts = append(opts, dns.WithForwarders(upstreams...))
+	}
+	if *FlagRateLimit > 0 {
+		rateLimit := dns.DefaultRateLimitConfig()
+		rateLimit.ResponsesPerSecond = *FlagRateLimit
+		rateLimit.LogOnly = *FlagRateLimitLogOnly
+		opts = append(opts, dns.WithResponseRateLimit(rateLimit))
+	}
+	if *FlagClientQps > 0 {
+		limits := dns.DefaultClientLimits()
+		limits.QueriesPerSecond = *FlagClientQps
+		opts = append(opts, dns.WithClientLimits(limits))
+	}
+	if *FlagRootHints != "" {
+		opts = append(opts, dns.WithRootHints(*FlagRootHints))
+	}
+
+	server, err := dns.NewServer(opts...)
 	if err != nil {
 		slog.Error("failed to create server", "error", err)
 		os.Exit(1)
 	}
 
+	// shut down gracefully on the first signal, a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *FlagShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown did not complete in time", "error", err)
+		}
+	}()
+
 	if err := server.Run(); err != nil {
 		slog.Error("failed to run server", "error", err)
 		os.Exit(1)